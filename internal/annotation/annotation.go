@@ -0,0 +1,51 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package annotation decodes the records registry-proxy keeps in the annotations
+// of the rewritten pods and objects, shared by the webhook and the controllers.
+package annotation
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/ketches/registry-proxy/internal/global"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// OriginalImages returns the original images recorded on the pod or the object,
+// keyed by container name or image field path, an empty map if not recorded.
+func OriginalImages(obj metav1.Object) map[string]string {
+	return stringMap(obj, global.PodAnnotationOriginalImages, "original images")
+}
+
+// MirroredRegistries returns the mirrored registries recorded on the pod, keyed
+// by mirror host, an empty map if not recorded.
+func MirroredRegistries(obj metav1.Object) map[string]string {
+	return stringMap(obj, global.PodAnnotationMirroredRegistries, "mirrored registries")
+}
+
+// stringMap returns the JSON string map in the annotation of the object, an
+// empty map if absent or malformed.
+func stringMap(obj metav1.Object, key, what string) map[string]string {
+	result := make(map[string]string)
+	if v := obj.GetAnnotations()[key]; v != "" {
+		if err := json.Unmarshal([]byte(v), &result); err != nil {
+			log.Printf("Unmarshal %s of %s/%s failed: %v", what, obj.GetNamespace(), obj.GetName(), err)
+		}
+	}
+	return result
+}
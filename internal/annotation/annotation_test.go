@@ -0,0 +1,59 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package annotation
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/ketches/registry-proxy/internal/global"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestOriginalImages(t *testing.T) {
+	obj := &metav1.ObjectMeta{Name: "app", Namespace: "default", Annotations: map[string]string{
+		global.PodAnnotationOriginalImages: `{"app":"nginx","/spec/template/spec/containers/0/image":"busybox"}`,
+	}}
+	expected := map[string]string{"app": "nginx", "/spec/template/spec/containers/0/image": "busybox"}
+	if result := OriginalImages(obj); !maps.Equal(result, expected) {
+		t.Errorf("original images failed, expected: %v, got: %v", expected, result)
+	}
+	if result := OriginalImages(&metav1.ObjectMeta{}); result == nil || len(result) != 0 {
+		t.Errorf("original images of object without record should be an empty map, got: %v", result)
+	}
+}
+
+func TestMirroredRegistries(t *testing.T) {
+	testdata := []struct {
+		annotations map[string]string
+		result      map[string]string
+	}{
+		{annotations: nil, result: map[string]string{}},
+		{annotations: map[string]string{global.PodAnnotationMirroredRegistries: "{invalid"}, result: map[string]string{}},
+		{
+			annotations: map[string]string{global.PodAnnotationMirroredRegistries: `{"ghcr.linkos.org":"ghcr.io"}`},
+			result:      map[string]string{"ghcr.linkos.org": "ghcr.io"},
+		},
+	}
+
+	for _, td := range testdata {
+		obj := &metav1.ObjectMeta{Name: "app", Namespace: "default", Annotations: td.annotations}
+		if result := MirroredRegistries(obj); !maps.Equal(result, td.result) {
+			t.Errorf("mirrored registries of %v failed, expected: %v, got: %v", td.annotations, td.result, result)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/ketches/registry-proxy/internal/config"
+	"github.com/ketches/registry-proxy/internal/global"
+)
+
+// podOptions is the rewrite options of a pod or an object of the configured
+// resources, read from its annotations and namespace
+type podOptions struct {
+	// profile is the profile selected by the pod's namespace
+	profile *config.Profile
+	// skip skips rewriting all images of the pod
+	skip bool
+	// skipContainers is the names of containers whose images are not rewritten
+	skipContainers map[string]bool
+	// mirrors is the forced mirrors keyed by registry, the empty key applies to all proxied images
+	mirrors map[string]string
+	// credentials returns the credential keys of the pull secrets of the pod, see
+	// podCredentials. It is looked up once by the first image checked for privacy.
+	credentials func() []string
+}
+
+// parsePodOptions parses the rewrite options from the annotations and the
+// profile selected by the namespace.
+func parsePodOptions(annotations map[string]string, namespace string) *podOptions {
+	opts := &podOptions{
+		profile:        config.GetProfile(namespaceProfile(namespace)),
+		skipContainers: make(map[string]bool),
+		mirrors:        make(map[string]string),
+	}
+
+	if v, ok := annotations[global.PodAnnotationSkip]; ok {
+		opts.skip, _ = strconv.ParseBool(v)
+	}
+	for _, name := range splitList(annotations[global.PodAnnotationSkipContainers]) {
+		opts.skipContainers[name] = true
+	}
+	for _, item := range splitList(annotations[global.PodAnnotationMirror]) {
+		if registry, mirror, ok := strings.Cut(item, "="); ok {
+			opts.mirrors[strings.TrimSpace(registry)] = strings.TrimSpace(mirror)
+		} else {
+			opts.mirrors[""] = item
+		}
+	}
+	return opts
+}
+
+// forcedMirror returns the mirror forced for the registry, ok is false if not forced.
+// A mirror forced for all images only applies to images proxied by the config.
+func (opts *podOptions) forcedMirror(registry string, proxied bool) (mirror string, ok bool) {
+	if opts == nil {
+		return "", false
+	}
+	if mirror, ok = opts.mirrors[registry]; ok {
+		return mirror, true
+	}
+	if !proxied {
+		return "", false
+	}
+	mirror, ok = opts.mirrors[""]
+	return mirror, ok
+}
+
+// splitList splits the comma separated list, empty items are dropped
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/ketches/registry-proxy/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ephemeralContainersSubResource is the pods subresource adding ephemeral containers
+const ephemeralContainersSubResource = "ephemeralcontainers"
+
+// patchEphemeralContainers generates the patch for the ephemeral containers
+// added by the pods/ephemeralcontainers subresource request. Ephemeral containers
+// present in the old pod are immutable and never patched, and the metadata is
+// not recorded since the subresource ignores changes out of ephemeral containers.
+func patchEphemeralContainers(ctx context.Context, pod, oldPod *corev1.Pod, opts *podOptions) ([]byte, error) {
+	existing := make(map[string]bool)
+	if oldPod != nil {
+		for _, c := range oldPod.Spec.EphemeralContainers {
+			existing[c.Name] = true
+		}
+	}
+
+	var patches []map[string]any
+	for i, c := range pod.Spec.EphemeralContainers {
+		if existing[c.Name] || opts.skipContainers[c.Name] {
+			continue
+		}
+		if proxyImage := getProxyImage(ctx, c.Image, opts); proxyImage != c.Image {
+			patches = append(patches, replacePatch(fmt.Sprintf("/spec/ephemeralContainers/%d/image", i), proxyImage))
+		}
+	}
+	if len(patches) == 0 {
+		return nil, nil
+	}
+
+	log.Printf("Ephemeral containers of pod %s/%s are included", pod.Namespace, util.ValueIf(pod.Name != "", pod.Name, pod.GenerateName))
+	return json.Marshal(patches)
+}
@@ -22,9 +22,13 @@ import (
 	"log"
 	"os"
 	"slices"
+	"sync"
 
 	"github.com/ketches/registry-proxy/internal/config"
+	"github.com/ketches/registry-proxy/internal/fallback"
 	"github.com/ketches/registry-proxy/internal/global"
+	"github.com/ketches/registry-proxy/internal/health"
+	"github.com/ketches/registry-proxy/internal/pullsecret"
 	"github.com/ketches/registry-proxy/pkg/kube"
 	"github.com/ketches/registry-proxy/pkg/util"
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
@@ -32,7 +36,9 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
 	informerscorev1 "k8s.io/client-go/informers/core/v1"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	certuitl "k8s.io/client-go/util/cert"
 	"k8s.io/client-go/util/retry"
@@ -45,18 +51,46 @@ var (
 	key  []byte
 )
 
+var (
+	// namespaceLister lists the Namespaces from the informer cache
+	namespaceLister listerscorev1.NamespaceLister
+	// accountFactory watches the ServiceAccounts of all namespaces
+	accountFactory informers.SharedInformerFactory
+	// serviceAccountLister lists the ServiceAccounts from the informer cache
+	serviceAccountLister listerscorev1.ServiceAccountLister
+	// credentialFactory watches the dockerconfigjson Secrets of all namespaces,
+	// shared by the webhook and the pull secret controller
+	credentialFactory informers.SharedInformerFactory
+	// credentialLister lists the dockerconfigjson Secrets from the informer cache
+	credentialLister listerscorev1.SecretLister
+)
+
+var (
+	controllersMu sync.Mutex
+	// pullSecretControllerStarted and fallbackControllerStarted mark the
+	// controllers started by runControllers
+	pullSecretControllerStarted, fallbackControllerStarted bool
+)
+
 // Init initializes the registry-proxy. Do the following things:
 //
-// 1. Watch the ConfigMap and trigger config reset.
+// 1. Watch the ConfigMap and trigger config reset, the informers and controllers
+// of the features are started once configured, see runControllers.
 //
-// 2. Create or reset the TLS cert and key secret.
+// 2. Watch the Namespaces to select profiles.
 //
-// 3. Create or reset the MutatingWebhookConfiguration to use the new cert and config.
+// 3. Create or reset the TLS cert and key secret.
+//
+// 4. Create or reset the MutatingWebhookConfiguration to use the new cert and config.
 func Init() {
 	fmt.Println("Welcome to use registry-proxy!")
 
+	newCredentialInformers()
+
 	runConfigMapInformer()
 
+	runNamespaceInformer()
+
 	applyTLSCertSecret()
 
 	applyWebhook()
@@ -127,6 +161,88 @@ func runConfigMapInformer() {
 	}()
 }
 
+// runNamespaceInformer watches the Namespaces, so that the profile of a namespace
+// is looked up from the cache instead of the API server on every admission.
+func runNamespaceInformer() {
+	namespaceInformer := informerscorev1.NewNamespaceInformer(kube.Client(), 0, cache.Indexers{})
+	namespaceLister = listerscorev1.NewNamespaceLister(namespaceInformer.GetIndexer())
+
+	go func() {
+		namespaceInformer.Run(wait.NeverStop)
+	}()
+	go func() {
+		if !cache.WaitForCacheSync(wait.NeverStop, namespaceInformer.HasSynced) {
+			panic("timed out waiting for caches to sync")
+		}
+	}()
+}
+
+// newCredentialInformers creates the informers of the ServiceAccounts and the
+// dockerconfigjson Secrets, so that the credentials of a pod are looked up from
+// the cache instead of the API server on every admission. They are started by
+// runControllers once needed, the listers find nothing until then.
+func newCredentialInformers() {
+	accountFactory = informers.NewSharedInformerFactory(kube.Client(), 0)
+	serviceAccountLister = accountFactory.Core().V1().ServiceAccounts().Lister()
+	credentialFactory = pullsecret.NewCredentialInformerFactory(kube.Client())
+	credentialLister = credentialFactory.Core().V1().Secrets().Lister()
+}
+
+// runControllers starts the informers and controllers of the features the first
+// time they are configured, so that no cluster-wide informer runs for a feature
+// never used. Once started they keep running, the fallback controller checks
+// the config on every reconciliation, and the pull secret controller deletes
+// the pull secrets no longer referenced.
+func runControllers() {
+	controllersMu.Lock()
+	defer controllersMu.Unlock()
+
+	if config.GetPrivateImages().Enabled {
+		accountFactory.Start(wait.NeverStop)
+		credentialFactory.Start(wait.NeverStop)
+	}
+	if config.PullSecretsEnabled() && !pullSecretControllerStarted {
+		pullSecretControllerStarted = true
+		runPullSecretController()
+	}
+	if config.GetFallback().Enabled && !fallbackControllerStarted {
+		fallbackControllerStarted = true
+		runFallbackController()
+	}
+}
+
+// runPullSecretController runs the controller replicating the pull secrets of
+// mirrors from the registry-proxy namespace, it starts the shared credential
+// informers too.
+func runPullSecretController() {
+	go pullsecret.NewController(kube.Client(), global.TargetNamespace, credentialFactory).Run(wait.NeverStop)
+}
+
+// runFallbackController runs the controller falling back from the mirrors which
+// the rewritten pods are stuck pulling from.
+func runFallbackController() {
+	go fallback.NewController(kube.Client()).Run(wait.NeverStop)
+}
+
+// namespaceProfile returns the profile name selected by the namespace's label or
+// annotation, the label takes precedence. It is empty if the namespace selects none.
+func namespaceProfile(namespace string) string {
+	if namespaceLister == nil || namespace == "" {
+		return ""
+	}
+	ns, err := namespaceLister.Get(namespace)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			log.Printf("Get namespace %s from cache failed: %v", namespace, err)
+		}
+		return ""
+	}
+	if profile := ns.Labels[global.NamespaceProfileKey]; profile != "" {
+		return profile
+	}
+	return ns.Annotations[global.NamespaceProfileKey]
+}
+
 // tryResetConfigFromConfigMap tries to reset the config from the ConfigMap.
 func tryResetConfigFromConfigMap(cm *corev1.ConfigMap) {
 	var data []byte
@@ -137,6 +253,12 @@ func tryResetConfigFromConfigMap(cm *corev1.ConfigMap) {
 	// reset config
 	config.Reset(data)
 
+	// reconcile the health check of mirrors
+	health.SetTargets(config.GetHealthCheckTargets())
+
+	// start the informers and controllers of the newly configured features
+	runControllers()
+
 	// try to update the MutatingWebhookConfiguration
 	applyWebhook()
 }
@@ -172,13 +294,59 @@ func constructWebhook() *admissionregistrationv1.MutatingWebhookConfiguration {
 						},
 						Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
 					},
+					{
+						// ephemeral containers, e.g. of kubectl debug, are added by updating the subresource
+						Rule: admissionregistrationv1.Rule{
+							APIGroups:   []string{""},
+							APIVersions: []string{"v1"},
+							Resources:   []string{"pods/" + ephemeralContainersSubResource},
+							Scope:       util.Ptr(admissionregistrationv1.NamespacedScope),
+						},
+						Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Update},
+					},
 				},
-				SideEffects:    util.Ptr(admissionregistrationv1.SideEffectClassNone),
-				TimeoutSeconds: util.Ptr(int32(5)),
+				ReinvocationPolicy: util.Ptr(config.ReinvocationPolicy()),
+				SideEffects:        util.Ptr(admissionregistrationv1.SideEffectClassNone),
+				TimeoutSeconds:     util.Ptr(int32(global.WebhookTimeoutSeconds)),
 			},
 		},
 	}
 
+	// the workloads whose pod templates are rewritten
+	if config.WorkloadsEnabled() {
+		for _, group := range []string{"apps", "batch"} {
+			var resources []string
+			for gvr := range workloadTemplatePaths {
+				if gvr.Group == group {
+					resources = append(resources, gvr.Resource)
+				}
+			}
+			slices.Sort(resources)
+			result.Webhooks[0].Rules = append(result.Webhooks[0].Rules, admissionregistrationv1.RuleWithOperations{
+				Rule: admissionregistrationv1.Rule{
+					APIGroups:   []string{group},
+					APIVersions: []string{"v1"},
+					Resources:   resources,
+					Scope:       util.Ptr(admissionregistrationv1.NamespacedScope),
+				},
+				Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+			})
+		}
+	}
+
+	// the resources out of pods holding images
+	for _, r := range config.GetResources() {
+		result.Webhooks[0].Rules = append(result.Webhooks[0].Rules, admissionregistrationv1.RuleWithOperations{
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{r.Group},
+				APIVersions: []string{r.Version},
+				Resources:   []string{r.Resource},
+				Scope:       util.Ptr(admissionregistrationv1.AllScopes),
+			},
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+		})
+	}
+
 	if v := config.GetExcludeNamespaces(); len(v) > 0 {
 		var selector metav1.LabelSelectorRequirement
 		if slices.Contains(v, "*") {
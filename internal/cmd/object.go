@@ -0,0 +1,127 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/ketches/registry-proxy/internal/annotation"
+	"github.com/ketches/registry-proxy/internal/config"
+	"github.com/ketches/registry-proxy/pkg/util"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// mutateObject mutates the object of a configured resource of the admission
+// request, the object is handled as unstructured so that no Go types of the
+// resource are needed.
+func mutateObject(ctx context.Context, w http.ResponseWriter, request *admissionv1.AdmissionReview, resource *config.Resource) {
+	obj, oldObj, err := parseObject(request)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not parse request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if obj.GetDeletionTimestamp() != nil {
+		response(w, request, nil)
+		return
+	}
+
+	opts := parsePodOptions(obj.GetAnnotations(), request.Request.Namespace)
+	if opts.skip {
+		log.Printf("%s %s/%s is skipped by annotation", obj.GetKind(), obj.GetNamespace(), objectName(obj))
+		response(w, request, nil)
+		return
+	}
+
+	patchBytes, err := patchObject(ctx, obj, oldObj, resource, opts)
+	if err != nil {
+		log.Println("Marshal patch failed.")
+		http.Error(w, fmt.Sprintf("could not marshal patch: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response(w, request, patchBytes)
+}
+
+// parseObject parses the object of the admission request, the old object is
+// nil if the request has no old object, e.g. on creation.
+func parseObject(request *admissionv1.AdmissionReview) (*unstructured.Unstructured, *unstructured.Unstructured, error) {
+	var (
+		obj    = &unstructured.Unstructured{}
+		oldObj *unstructured.Unstructured
+	)
+
+	if err := obj.UnmarshalJSON(request.Request.Object.Raw); err != nil {
+		log.Println("Unmarshal object failed.", err.Error())
+		return nil, nil, fmt.Errorf("could not unmarshal object: %v", err)
+	}
+
+	if raw := request.Request.OldObject.Raw; len(raw) > 0 {
+		oldObj = &unstructured.Unstructured{}
+		if err := oldObj.UnmarshalJSON(raw); err != nil {
+			log.Println("Unmarshal old object failed.", err.Error())
+			return nil, nil, fmt.Errorf("could not unmarshal old object: %v", err)
+		}
+	}
+
+	return obj, oldObj, nil
+}
+
+// patchObject generates the patch for the object, the old object is nil on
+// creation. The images at the field paths of the resource are rewritten and
+// recorded keyed by their JSON pointers, e.g. /spec/steps/0/image.
+func patchObject(ctx context.Context, obj, oldObj *unstructured.Unstructured, resource *config.Resource, opts *podOptions) ([]byte, error) {
+	rw := newRewriter(ctx, opts, annotation.OriginalImages(obj))
+	if oldObj != nil {
+		rw.setOld(annotation.OriginalImages(oldObj), objectImages(oldObj, resource))
+	}
+
+	for _, p := range resource.FieldPaths() {
+		p.Walk(obj.Object, func(pointer, value string) {
+			rw.replace(pointer, pointer, &value)
+		})
+	}
+	if len(rw.patches) == 0 {
+		return nil, nil
+	}
+
+	log.Printf("%s %s/%s is included", obj.GetKind(), obj.GetNamespace(), objectName(obj))
+
+	return json.Marshal(append(rw.patches, recordPatches(obj, rw.originals, nil)...))
+}
+
+// objectImages returns the images at the field paths of the resource keyed by
+// their JSON pointers.
+func objectImages(obj *unstructured.Unstructured, resource *config.Resource) map[string]string {
+	images := make(map[string]string)
+	for _, p := range resource.FieldPaths() {
+		p.Walk(obj.Object, func(pointer, value string) {
+			images[pointer] = value
+		})
+	}
+	return images
+}
+
+// objectName returns the name of the object, or the generateName if the name is not set yet
+func objectName(obj *unstructured.Unstructured) string {
+	return util.ValueIf(obj.GetName() != "", obj.GetName(), obj.GetGenerateName())
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/ketches/registry-proxy/internal/config"
+	"github.com/ketches/registry-proxy/pkg/util"
+)
+
+// pinDigest pins the tag of the rewritten image to its manifest digest.
+// The rewritten image is returned unpinned if the digest can not be resolved.
+// The upstream is the reference the image is rewritten from, e.g. with the
+// unqualified registry or the alias of the registry applied.
+func pinDigest(ctx context.Context, pin config.PinDigest, upstream, rewritten string) string {
+	if strings.Contains(rewritten, "@") {
+		// already pinned by digest
+		return rewritten
+	}
+
+	target := util.ValueIf(pin.ResolveFrom == config.PinDigestResolveFromUpstream, upstream, rewritten)
+	digest, err := resolveDigest(ctx, target, pin.CacheTTL)
+	if err != nil {
+		log.Printf("Resolve digest of %s failed, keep image unpinned: %v", target, err)
+		return rewritten
+	}
+
+	result := rewritten + "@" + digest
+	log.Printf("Pin image: %s -> %s", rewritten, result)
+	return result
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ketches/registry-proxy/internal/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPinDigest(t *testing.T) {
+	const (
+		upstreamDigest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+		mirrorDigest   = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+		pinnedDigest   = "sha256:3333333333333333333333333333333333333333333333333333333333333333"
+	)
+	upstream := newTestRegistry(t, map[string]string{"org/app:v1": upstreamDigest})
+	mirror := newTestRegistry(t, map[string]string{"org/app:v1": mirrorDigest})
+	slow := newTestRegistry(t, map[string]string{"org/app:v1": mirrorDigest})
+	slow.delay = 500 * time.Millisecond
+	// the upstream registry is configured as a mirror of another registry to trust its certificate
+	reset := func(resolveFrom string) {
+		config.Reset([]byte(fmt.Sprintf(`
+proxies:
+  %s:
+    host: %s
+    insecureSkipVerify: true
+  slow.test:
+    host: %s
+    insecureSkipVerify: true
+  registry.test:
+    host: %s
+    insecureSkipVerify: true
+pinDigest:
+  enabled: true
+  resolveFrom: %s
+  timeout: 100ms
+`, upstream.host, mirror.host, slow.host, upstream.host, resolveFrom)))
+	}
+	defer config.Reset(nil)
+
+	testdata := []struct {
+		resolveFrom string
+		image       string
+		result      string
+	}{
+		// the tag is pinned to the digest on the mirror
+		{resolveFrom: "mirror", image: upstream.host + "/org/app:v1", result: mirror.host + "/org/app:v1@" + mirrorDigest},
+		// the image is rewritten unpinned if the digest can not be resolved
+		{resolveFrom: "mirror", image: upstream.host + "/org/missing:v1", result: mirror.host + "/org/missing:v1"},
+		{resolveFrom: "mirror", image: "slow.test/org/app:v1", result: slow.host + "/org/app:v1"},
+		// the image pinned already is kept pinned to its digest
+		{resolveFrom: "mirror", image: upstream.host + "/org/app@" + pinnedDigest, result: mirror.host + "/org/app@" + pinnedDigest},
+		// the tag is pinned to the digest on the upstream registry
+		{resolveFrom: "upstream", image: upstream.host + "/org/app:v1", result: mirror.host + "/org/app:v1@" + upstreamDigest},
+	}
+	for _, td := range testdata {
+		reset(td.resolveFrom)
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: td.image}}},
+		}
+		pod, _ = invoke(t, pod)
+		if result := pod.Spec.Containers[0].Image; result != td.result {
+			t.Errorf("pin digest of %s from %s failed, expected: %s, got: %s", td.image, td.resolveFrom, td.result, result)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/ketches/registry-proxy/internal/config"
+	"github.com/ketches/registry-proxy/internal/global"
+	"github.com/ketches/registry-proxy/internal/pullsecret"
+	"github.com/ketches/registry-proxy/pkg/cache"
+	"github.com/ketches/registry-proxy/pkg/image"
+	"github.com/ketches/registry-proxy/pkg/registry"
+	"github.com/ketches/registry-proxy/pkg/util"
+	"golang.org/x/sync/singleflight"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+var (
+	// probeCache caches whether the repositories can be pulled anonymously, keyed
+	// by registry and repository
+	probeCache = cache.New[string, bool](digestCacheSize)
+	// probeGroup deduplicates concurrent probes of the same repository
+	probeGroup singleflight.Group
+)
+
+// podCredentials returns the credential keys of the image pull secrets of the pod
+// and its service account, e.g. docker.io or ghcr.io/org. The pull secrets of the
+// mirrors are excluded. They are looked up from the informer caches, none is
+// found before the caches are synced.
+func podCredentials(pod *corev1.Pod, namespace string) []string {
+	if serviceAccountLister == nil || credentialLister == nil {
+		return nil
+	}
+
+	var names []string
+	for _, ref := range pod.Spec.ImagePullSecrets {
+		names = append(names, ref.Name)
+	}
+	name := util.ValueIf(pod.Spec.ServiceAccountName != "", pod.Spec.ServiceAccountName, "default")
+	account, err := serviceAccountLister.ServiceAccounts(namespace).Get(name)
+	if err == nil {
+		for _, ref := range account.ImagePullSecrets {
+			names = append(names, ref.Name)
+		}
+	} else if !apierrors.IsNotFound(err) {
+		log.Printf("Get service account %s/%s from cache failed: %v", namespace, name, err)
+	}
+
+	var keys []string
+	for _, name := range slices.Compact(slices.Sorted(slices.Values(names))) {
+		if strings.HasPrefix(name, global.PullSecretPrefix) {
+			continue
+		}
+		secret, err := credentialLister.Secrets(namespace).Get(name)
+		if err != nil {
+			if !apierrors.IsNotFound(err) {
+				log.Printf("Get pull secret %s/%s from cache failed: %v", namespace, name, err)
+			}
+			continue
+		}
+		keys = append(keys, pullsecret.CredentialKeys(secret)...)
+	}
+	return keys
+}
+
+// privateReason returns why the image is private, empty if it is not. An image
+// is private if the pull secrets of the pod contain credentials for its registry,
+// or, if probe is enabled, the registry denies the anonymous access to it.
+func privateReason(ctx context.Context, p config.PrivateImages, ref *image.Reference, opts *podOptions) string {
+	name := ref.Registry + "/" + ref.Repository + "/"
+	var credentials []string
+	if opts.credentials != nil {
+		credentials = opts.credentials()
+	}
+	for _, key := range credentials {
+		if strings.HasPrefix(name, key+"/") {
+			return fmt.Sprintf("pull secrets contain credentials for %s", key)
+		}
+	}
+	if p.Probe && !anonymousAccessible(ctx, ref, p) {
+		return fmt.Sprintf("anonymous access is denied by %s", ref.Registry)
+	}
+	return ""
+}
+
+// anonymousAccessible probes whether the image can be pulled anonymously from
+// its registry. Denied and granted results are cached for ttl, the image is
+// treated as accessible if the probe fails otherwise. As resolveDigest, the
+// shared probe is detached from the deadline of the first caller.
+func anonymousAccessible(ctx context.Context, ref *image.Reference, p config.PrivateImages) bool {
+	key := ref.Registry + "/" + ref.Repository
+	if accessible, ok := probeCache.Get(key); ok {
+		return accessible
+	}
+
+	ch := probeGroup.DoChan(key, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), p.Timeout)
+		defer cancel()
+
+		reference := util.ValueIf(ref.Digest != "", ref.Digest, ref.Tag)
+		_, err := registryClientFor(ref.Registry).Digest(ctx, ref.Registry, ref.Repository, reference)
+		switch {
+		case err == nil, errors.Is(err, registry.ErrNotFound):
+			probeCache.Set(key, true, p.CacheTTL)
+			return true, nil
+		case errors.Is(err, registry.ErrUnauthorized):
+			probeCache.Set(key, false, p.CacheTTL)
+			return false, nil
+		}
+		return nil, err
+	})
+
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case result := <-ch:
+		if result.Err == nil {
+			return result.Val.(bool)
+		}
+		err = result.Err
+	}
+	log.Printf("Probe anonymous access of %s failed, treat it as public: %v", key, err)
+	return true
+}
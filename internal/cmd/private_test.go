@@ -0,0 +1,194 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ketches/registry-proxy/internal/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestPrivateImagesByCredentials(t *testing.T) {
+	setCredentials(t,
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "ghcr-auth", Namespace: "default"},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths":{"ghcr.io/our-org":{"auth":"dXNlcjpwYXNz"}}}`)},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "quay-auth", Namespace: "default"},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths":{"https://quay.io":{"auth":"dXNlcjpwYXNz"}}}`)},
+		},
+		&corev1.ServiceAccount{
+			ObjectMeta:       metav1.ObjectMeta{Name: "builder", Namespace: "default"},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "quay-auth"}},
+		},
+	)
+	config.Reset([]byte(`
+proxies:
+  ghcr.io: ghcr.linkos.org
+  quay.io: quay.linkos.org
+  docker.io: docker.linkos.org
+privateImages:
+  enabled: true
+`))
+	defer config.Reset(nil)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			ServiceAccountName: "builder",
+			ImagePullSecrets:   []corev1.LocalObjectReference{{Name: "ghcr-auth"}},
+			Containers: []corev1.Container{
+				{Name: "app", Image: "ghcr.io/our-org/app:v1"},
+				{Name: "tool", Image: "ghcr.io/other-org/tool:v1"},
+				{Name: "builder", Image: "quay.io/our-org/builder:v1"},
+				{Name: "nginx", Image: "nginx:1.25"},
+			},
+		},
+	}
+
+	pod, _ = invoke(t, pod)
+	expected := map[string]string{
+		"app":     "ghcr.io/our-org/app:v1",
+		"tool":    "ghcr.linkos.org/other-org/tool:v1",
+		"builder": "quay.io/our-org/builder:v1",
+		"nginx":   "docker.linkos.org/library/nginx:1.25",
+	}
+	images := mutableImages(pod, false)
+	for name, image := range expected {
+		if images[name] != image {
+			t.Errorf("skip private images failed, expected image of %s: %s, got: %s", name, image, images[name])
+		}
+	}
+}
+
+func TestPrivateImagesByProbe(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			if strings.HasPrefix(r.URL.Query().Get("scope"), "repository:private/") {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"token":"anonymous"}`)
+		case r.Header.Get("Authorization") != "Bearer anonymous":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.Header().Set("Docker-Content-Digest", "sha256:0000000000000000000000000000000000000000000000000000000000000000")
+		}
+	}))
+	defer server.Close()
+
+	// the upstream registry is configured as a mirror of another registry to trust its certificate
+	host := strings.TrimPrefix(server.URL, "https://")
+	config.Reset([]byte(fmt.Sprintf(`
+proxies:
+  %s: mirror.corp
+  registry.test:
+    host: %s
+    insecureSkipVerify: true
+privateImages:
+  enabled: true
+  probe: true
+`, host, host)))
+	defer config.Reset(nil)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "public", Image: host + "/public/app:v1"},
+				{Name: "private", Image: host + "/private/app:v1"},
+			},
+		},
+	}
+
+	pod, _ = invoke(t, pod)
+	expected := map[string]string{
+		"public":  "mirror.corp/public/app:v1",
+		"private": host + "/private/app:v1",
+	}
+	images := mutableImages(pod, false)
+	for name, image := range expected {
+		if images[name] != image {
+			t.Errorf("probe private images failed, expected image of %s: %s, got: %s", name, image, images[name])
+		}
+	}
+	if accessible, ok := probeCache.Get(host + "/private/app"); !ok || accessible {
+		t.Errorf("probe result of private image should be cached")
+	}
+}
+
+func TestPrivateImagesCredentialsLookup(t *testing.T) {
+	config.Reset([]byte(`
+proxies:
+  docker.io: docker.linkos.org
+privateImages:
+  enabled: true
+`))
+	defer config.Reset(nil)
+
+	var lookups int
+	opts := &podOptions{
+		profile:        config.GetProfile(""),
+		skipContainers: make(map[string]bool),
+		mirrors:        make(map[string]string),
+		credentials:    func() []string { lookups++; return nil },
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "registry.corp/app:v1"}}},
+	}
+	replaceImage(context.Background(), pod, nil, opts, false)
+	if lookups != 0 {
+		t.Errorf("credentials should not be looked up when no image is rewritten, got %d lookups", lookups)
+	}
+}
+
+// setCredentials serves the service accounts and the secrets from the informer
+// caches of podCredentials until the test ends.
+func setCredentials(t *testing.T, objs ...runtime.Object) {
+	accounts := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	secrets := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, obj := range objs {
+		switch obj.(type) {
+		case *corev1.ServiceAccount:
+			accounts.Add(obj)
+		case *corev1.Secret:
+			secrets.Add(obj)
+		}
+	}
+	serviceAccountLister = listerscorev1.NewServiceAccountLister(accounts)
+	credentialLister = listerscorev1.NewSecretLister(secrets)
+	t.Cleanup(func() {
+		serviceAccountLister, credentialLister = nil, nil
+	})
+}
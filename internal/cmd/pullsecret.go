@@ -0,0 +1,153 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/ketches/registry-proxy/internal/annotation"
+	"github.com/ketches/registry-proxy/internal/config"
+	"github.com/ketches/registry-proxy/internal/global"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// pullSecretPatches generates the patches adding the pull secrets of the mirrors
+// which the images of the pod are rewritten to. The pull secrets are replicated
+// into the namespace of the pod by the pull secret controller.
+func pullSecretPatches(pod *corev1.Pod) []map[string]any {
+	var names []string
+	add := func(image string) {
+		source := config.GetPullSecret(image)
+		if source == "" {
+			return
+		}
+		name := global.PullSecretPrefix + source
+		if !slices.Contains(names, name) && !slices.ContainsFunc(pod.Spec.ImagePullSecrets, func(ref corev1.LocalObjectReference) bool {
+			return ref.Name == name
+		}) {
+			names = append(names, name)
+		}
+	}
+	for _, c := range slices.Concat(pod.Spec.InitContainers, pod.Spec.Containers) {
+		add(c.Image)
+	}
+	for _, v := range pod.Spec.Volumes {
+		if v.Image != nil {
+			add(v.Image.Reference)
+		}
+	}
+
+	return imagePullSecretPatches(pod.Spec.ImagePullSecrets, names)
+}
+
+// mirroredPullSecretPatches generates the patches adding the pull secrets derived
+// from the image pull secrets of the pod, for the images rewritten to mirrors
+// passing the credentials through. The derived pull secrets are generated by the
+// pull secret controller with the returned annotations, which record the
+// original registry of each mirror host.
+func mirroredPullSecretPatches(pod *corev1.Pod, opts *podOptions, originals map[string]string) (patches []map[string]any, annotations map[string]string) {
+	record := annotation.OriginalImages(pod)
+	maps.Copy(record, originals)
+
+	registries := annotation.MirroredRegistries(pod)
+	found := false
+	add := func(key, rewritten string) {
+		original, ok := record[key]
+		if !ok {
+			return
+		}
+		host := config.GetCredentialMirror(rewritten)
+		if host == "" {
+			return
+		}
+		ref, _, err := opts.profile.ParseImage(original)
+		if err != nil {
+			return
+		}
+		registries[host] = config.CanonicalRegistry(ref.Registry)
+		found = true
+	}
+	for _, c := range slices.Concat(pod.Spec.InitContainers, pod.Spec.Containers) {
+		add(c.Name, c.Image)
+	}
+	for _, v := range pod.Spec.Volumes {
+		if v.Image != nil {
+			add(imageVolumeKey(v.Name), v.Image.Reference)
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+
+	var names []string
+	for _, ref := range pod.Spec.ImagePullSecrets {
+		if strings.HasPrefix(ref.Name, global.PullSecretPrefix) {
+			continue
+		}
+		name := global.MirroredPullSecretPrefix + ref.Name
+		if len(validation.IsDNS1123Subdomain(name)) > 0 || slices.ContainsFunc(pod.Spec.ImagePullSecrets, func(ref corev1.LocalObjectReference) bool {
+			return ref.Name == name
+		}) {
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 && len(pod.Annotations[global.PodAnnotationMirroredRegistries]) == 0 {
+		return nil, nil
+	}
+
+	out, _ := json.Marshal(registries)
+	return imagePullSecretPatches(pod.Spec.ImagePullSecrets, names), map[string]string{
+		global.PodAnnotationMirroredRegistries: string(out),
+	}
+}
+
+// imagePullSecretPatches generates the patches appending the names to the image
+// pull secrets, the field is added as a whole if absent.
+func imagePullSecretPatches(current []corev1.LocalObjectReference, names []string) []map[string]any {
+	if len(names) == 0 {
+		return nil
+	}
+
+	var refs []corev1.LocalObjectReference
+	for _, name := range names {
+		refs = append(refs, corev1.LocalObjectReference{Name: name})
+	}
+	if len(current) == 0 {
+		return []map[string]any{
+			{
+				"op":    "add",
+				"path":  "/spec/imagePullSecrets",
+				"value": refs,
+			},
+		}
+	}
+
+	var patches []map[string]any
+	for _, ref := range refs {
+		patches = append(patches, map[string]any{
+			"op":    "add",
+			"path":  "/spec/imagePullSecrets/-",
+			"value": ref,
+		})
+	}
+	return patches
+}
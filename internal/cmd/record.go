@@ -0,0 +1,77 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+
+	"github.com/ketches/registry-proxy/internal/annotation"
+	"github.com/ketches/registry-proxy/internal/config"
+	"github.com/ketches/registry-proxy/internal/global"
+	"github.com/ketches/registry-proxy/pkg/fieldpath"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// recordPatches generates the patches recording the original images of the
+// rewritten containers on the pod or the object, along with the extra annotations.
+// Originals of the other containers already recorded are kept, e.g. those
+// rewritten by a previous invocation.
+func recordPatches(obj metav1.Object, originals, annotations map[string]string) []map[string]any {
+	if len(originals) == 0 {
+		return nil
+	}
+
+	record := annotation.OriginalImages(obj)
+	maps.Copy(record, originals)
+	out, _ := json.Marshal(record)
+
+	values := map[string]string{
+		global.PodAnnotationOriginalImages:   string(out),
+		global.PodAnnotationConfigGeneration: config.GetGeneration(),
+	}
+	maps.Copy(values, annotations)
+	patches := metadataPatches("annotations", obj.GetAnnotations(), values)
+	return append(patches, metadataPatches("labels", obj.GetLabels(), map[string]string{
+		global.PodLabelProxied: "true",
+	})...)
+}
+
+// metadataPatches generates the patches setting the values into the metadata
+// field(annotations or labels), the field is added as a whole if absent.
+func metadataPatches(field string, current, values map[string]string) []map[string]any {
+	if current == nil {
+		return []map[string]any{
+			{
+				"op":    "add",
+				"path":  "/metadata/" + field,
+				"value": values,
+			},
+		}
+	}
+
+	var patches []map[string]any
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		patches = append(patches, map[string]any{
+			"op":    "add",
+			"path":  "/metadata/" + field + "/" + fieldpath.EscapePointer(key),
+			"value": values[key],
+		})
+	}
+	return patches
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ketches/registry-proxy/internal/config"
+	"github.com/ketches/registry-proxy/pkg/cache"
+	"github.com/ketches/registry-proxy/pkg/image"
+	"github.com/ketches/registry-proxy/pkg/registry"
+	"golang.org/x/sync/singleflight"
+)
+
+// digestCacheSize is the max number of resolved digests kept in the cache
+const digestCacheSize = 4096
+
+var (
+	// registryClients is the registry clients keyed by the TLS settings of mirrors
+	registryClients sync.Map
+	// digestCache caches the resolved digests keyed by image, an empty digest
+	// means the manifest does not exist
+	digestCache = cache.New[string, string](digestCacheSize)
+	// digestGroup deduplicates concurrent resolutions of the same image
+	digestGroup singleflight.Group
+)
+
+// registryClientFor returns the registry client using the TLS settings of the
+// mirror with the hostname, the default client is used for unknown hosts.
+func registryClientFor(hostname string) *registry.Client {
+	caBundle, insecure := config.GetMirrorTLS(hostname)
+	key := struct {
+		caBundle string
+		insecure bool
+	}{caBundle, insecure}
+	if client, ok := registryClients.Load(key); ok {
+		return client.(*registry.Client)
+	}
+
+	var httpClient *http.Client
+	if caBundle != "" || insecure {
+		transport, err := registry.NewTransport(caBundle, insecure)
+		if err != nil {
+			log.Printf("Create transport of mirror %s failed, use the default one: %v", hostname, err)
+		} else {
+			httpClient = &http.Client{Transport: transport}
+		}
+	}
+	client, _ := registryClients.LoadOrStore(key, registry.NewClient(httpClient))
+	return client.(*registry.Client)
+}
+
+// resolveDigest resolves the manifest digest of the image. Resolved digests and
+// missing manifests are cached for ttl, concurrent resolutions are deduplicated.
+// The shared resolution is detached from the deadline of the first caller, so
+// that it does not fail the other callers waiting for it.
+// The error wraps registry.ErrNotFound if the manifest does not exist.
+func resolveDigest(ctx context.Context, img string, ttl time.Duration) (string, error) {
+	ref, err := image.ParseReference(img)
+	if err != nil {
+		return "", err
+	}
+
+	key := ref.String()
+	if digest, ok := digestCache.Get(key); ok {
+		if digest == "" {
+			return "", registry.ErrNotFound
+		}
+		return digest, nil
+	}
+
+	ch := digestGroup.DoChan(key, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), config.GetResolveTimeout())
+		defer cancel()
+
+		reference := ref.Tag
+		if ref.Digest != "" {
+			reference = ref.Digest
+		}
+		digest, err := registryClientFor(ref.Registry).Digest(ctx, ref.Registry, ref.Repository, reference)
+		if err == nil || errors.Is(err, registry.ErrNotFound) {
+			digestCache.Set(key, digest, ttl)
+		}
+		return digest, err
+	})
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case result := <-ch:
+		if result.Err != nil {
+			return "", result.Err
+		}
+		return result.Val.(string), nil
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ketches/registry-proxy/internal/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestResolveDigestDetachedFromFirstCaller(t *testing.T) {
+	const digest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Header().Set("Docker-Content-Digest", digest)
+	}))
+	defer server.Close()
+
+	// the registry is configured as a mirror to trust its certificate
+	host := strings.TrimPrefix(server.URL, "https://")
+	config.Reset([]byte(fmt.Sprintf(`
+proxies:
+  registry.test:
+    host: %s
+    insecureSkipVerify: true
+`, host)))
+	defer config.Reset(nil)
+
+	img := host + "/library/app:v1"
+	first, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := resolveDigest(first, img, time.Minute)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	result, err := resolveDigest(context.Background(), img, time.Minute)
+	if err != nil || result != digest {
+		t.Errorf("resolution shared with a cancelled caller should succeed, got: %s, %v", result, err)
+	}
+	if err := <-done; err == nil {
+		t.Errorf("the first caller should fail with its own deadline")
+	}
+}
+
+func TestResolveUpstreamReference(t *testing.T) {
+	upstream := newTestRegistry(t, map[string]string{
+		"nginx:1.25": "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+		"org/app:v1": "sha256:2222222222222222222222222222222222222222222222222222222222222222",
+	})
+	mirror := newTestRegistry(t, map[string]string{
+		"nginx:1.25": "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+		"org/app:v1": "sha256:3333333333333333333333333333333333333333333333333333333333333333",
+	})
+	// the upstream registry is configured as a mirror of another registry to trust its certificate
+	reset := func(verify bool) {
+		config.Reset([]byte(fmt.Sprintf(`
+proxies:
+  %s:
+    host: %s
+    insecureSkipVerify: true
+  registry.test:
+    host: %s
+    insecureSkipVerify: true
+unqualifiedRegistry: %s
+aliases:
+  legacy.test: %s
+pinDigest:
+  enabled: true
+  resolveFrom: upstream
+verify:
+  enabled: %t
+  matchDigest: true
+`, upstream.host, mirror.host, upstream.host, upstream.host, upstream.host, verify)))
+	}
+	defer config.Reset(nil)
+
+	// the digests are resolved from the unqualified registry and the canonical
+	// registry the images are rewritten from, not from the raw images
+	testdata := []struct {
+		verify bool
+		image  string
+		result string
+	}{
+		{verify: true, image: "nginx:1.25", result: mirror.host + "/nginx:1.25@sha256:1111111111111111111111111111111111111111111111111111111111111111"},
+		{verify: false, image: "legacy.test/org/app:v1", result: mirror.host + "/org/app:v1@sha256:2222222222222222222222222222222222222222222222222222222222222222"},
+	}
+	for _, td := range testdata {
+		reset(td.verify)
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: td.image}}},
+		}
+		pod, _ = invoke(t, pod)
+		if result := pod.Spec.Containers[0].Image; result != td.result {
+			t.Errorf("resolve upstream reference of %s failed, expected: %s, got: %s", td.image, td.result, result)
+		}
+	}
+}
+
+// testRegistry is a registry serving the manifest digests keyed by repository:reference
+type testRegistry struct {
+	host    string
+	digests map[string]string
+	// delay delays the responses, e.g. to exceed the timeout
+	delay    time.Duration
+	requests atomic.Int32
+}
+
+// newTestRegistry starts a registry serving the digests until the test ends
+func newTestRegistry(t *testing.T, digests map[string]string) *testRegistry {
+	r := &testRegistry{digests: digests}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.requests.Add(1)
+		time.Sleep(r.delay)
+		name, reference, ok := strings.Cut(strings.TrimPrefix(req.URL.Path, "/v2/"), "/manifests/")
+		digest := r.digests[name+":"+reference]
+		if !ok || digest == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+	}))
+	t.Cleanup(server.Close)
+	r.host = strings.TrimPrefix(server.URL, "https://")
+	return r
+}
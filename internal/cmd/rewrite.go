@@ -0,0 +1,76 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import "context"
+
+// rewriter rewrites the images of a pod or an object idempotently:
+//
+// 1. On update, only the images changed from the old object are rewritten.
+//
+// 2. Images recorded with a different original image are already rewritten by a
+// previous invocation of the webhook and are kept, unless the record is the one
+// of the old object, i.e. the image is changed by the update.
+type rewriter struct {
+	ctx  context.Context
+	opts *podOptions
+
+	// recorded is the original images recorded on the object
+	recorded map[string]string
+	// update is whether the object is updated
+	update bool
+	// oldRecorded is the original images recorded on the old object
+	oldRecorded map[string]string
+	// oldImages is the images of the old object, keyed as the original images
+	oldImages map[string]string
+
+	// patches is the patches of the replaced images
+	patches []map[string]any
+	// originals is the original images of the replaced images
+	originals map[string]string
+}
+
+// newRewriter returns a rewriter of the object with the recorded original images
+func newRewriter(ctx context.Context, opts *podOptions, recorded map[string]string) *rewriter {
+	return &rewriter{
+		ctx:       ctx,
+		opts:      opts,
+		recorded:  recorded,
+		originals: make(map[string]string),
+	}
+}
+
+// setOld sets the recorded original images and the images of the old object on update
+func (rw *rewriter) setOld(oldRecorded, oldImages map[string]string) {
+	rw.update, rw.oldRecorded, rw.oldImages = true, oldRecorded, oldImages
+}
+
+// replace replaces the image at the JSON pointer path with the proxy image,
+// key is the key of the image in the original images.
+func (rw *rewriter) replace(key, path string, image *string) {
+	if rw.update && rw.oldImages[key] == *image {
+		return
+	}
+	if original, ok := rw.recorded[key]; ok && original != *image && original != rw.oldRecorded[key] {
+		return
+	}
+	if proxyImage := getProxyImage(rw.ctx, *image, rw.opts); proxyImage != *image {
+		rw.patches = append(rw.patches, replacePatch(path, proxyImage))
+		rw.originals[key] = *image
+		*image = proxyImage
+	}
+}
@@ -17,28 +17,34 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
-	"path"
+	"slices"
+	"strings"
+	"sync"
 
+	"github.com/ketches/registry-proxy/internal/annotation"
 	"github.com/ketches/registry-proxy/internal/config"
 	"github.com/ketches/registry-proxy/internal/global"
+	"github.com/ketches/registry-proxy/pkg/fieldpath"
 	"github.com/ketches/registry-proxy/pkg/image"
 	"github.com/ketches/registry-proxy/pkg/util"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/labels"
 )
 
-func init() {
-	Init()
-}
-
 // Run starts the registry-proxy admission webhook.
 func Run() {
-	http.HandleFunc(global.WebhookServicePath, mutatePod)
+	Init()
+
+	http.HandleFunc(global.WebhookServicePath, mutate)
+	http.Handle("/metrics", promhttp.Handler())
 	log.Println("Start serving registry-proxy admission webhook ...")
 
 	if err := http.ListenAndServeTLS(":443", global.WebhookServiceTLSCertFile, global.WebhookServiceTLSKeyFile, nil); err != nil {
@@ -46,16 +52,70 @@ func Run() {
 	}
 }
 
-// mutatePod is the handler of the admission webhook.
-func mutatePod(w http.ResponseWriter, r *http.Request) {
+// mutate is the handler of the admission webhook, the requests of pods and of
+// the configured resources are dispatched to their mutating functions.
+func mutate(w http.ResponseWriter, r *http.Request) {
 	log.Println("Request admission webhook mutating ...")
 
-	request, pod, err := parseRequest(r)
+	request, err := parseRequest(r)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("could not parse request: %v", err), http.StatusBadRequest)
 		return
 	}
 
+	// Only creation and update carry images to rewrite.
+	if op := request.Request.Operation; op != admissionv1.Create && op != admissionv1.Update {
+		response(w, request, nil)
+		return
+	}
+
+	// Bound the time spent on resolving images in this admission request.
+	ctx, cancel := context.WithTimeout(r.Context(), config.GetResolveTimeout())
+	defer cancel()
+
+	res := request.Request.Resource
+	if res.Group == "" && res.Resource == "pods" {
+		mutatePod(ctx, w, request)
+	} else if templatePath, ok := workloadTemplatePaths[res]; ok {
+		mutateWorkload(ctx, w, request, templatePath)
+	} else if resource := config.GetResource(res.Group, res.Version, res.Resource); resource != nil {
+		mutateObject(ctx, w, request, resource)
+	} else {
+		log.Printf("Resource %s is not proxied", res.String())
+		response(w, request, nil)
+	}
+}
+
+// parseRequest parses the admission review of the request.
+func parseRequest(r *http.Request) (*admissionv1.AdmissionReview, error) {
+	var request admissionv1.AdmissionReview
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Println("Decode body failed.")
+		return nil, fmt.Errorf("could not decode body: %v", err)
+	}
+	if request.Request == nil {
+		log.Println("Admission request is empty.")
+		return nil, fmt.Errorf("admission request is empty")
+	}
+
+	return &request, nil
+}
+
+// mutatePod mutates the pod of the admission request.
+func mutatePod(ctx context.Context, w http.ResponseWriter, request *admissionv1.AdmissionReview) {
+	pod, oldPod, err := parsePod(request)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not parse request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// A terminating pod only gets updates such as removing finalizers.
+	if pod.DeletionTimestamp != nil {
+		response(w, request, nil)
+		return
+	}
+
 	// If the pod not match the pod selector, return directly.
 	if selector := config.PodSelector().AsSelector(); !selector.Empty() {
 		if !selector.Matches(labels.Set(pod.Labels)) {
@@ -64,7 +124,25 @@ func mutatePod(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	patchBytes, err := patchPod(pod)
+	// The namespace of the pod may be empty on creation, use the request's namespace.
+	opts := parsePodOptions(pod.Annotations, request.Request.Namespace)
+	if opts.skip {
+		log.Printf("Pod %s/%s is skipped by annotation", pod.Namespace, util.ValueIf(pod.Name != "", pod.Name, pod.GenerateName))
+		response(w, request, nil)
+		return
+	}
+	if config.GetPrivateImages().Enabled {
+		opts.credentials = sync.OnceValue(func() []string {
+			return podCredentials(pod, request.Request.Namespace)
+		})
+	}
+
+	var patchBytes []byte
+	if request.Request.SubResource == ephemeralContainersSubResource {
+		patchBytes, err = patchEphemeralContainers(ctx, pod, oldPod, opts)
+	} else {
+		patchBytes, err = patchPod(ctx, pod, oldPod, opts)
+	}
 	if err != nil {
 		log.Println("Marshal patch failed.")
 		http.Error(w, fmt.Sprintf("could not marshal patch: %v", err), http.StatusInternalServerError)
@@ -74,16 +152,20 @@ func mutatePod(w http.ResponseWriter, r *http.Request) {
 	response(w, request, patchBytes)
 }
 
-// parseRequest parses the request of the admission webhook.
-func parseRequest(r *http.Request) (*admissionv1.AdmissionReview, *corev1.Pod, error) {
+// parsePod parses the pod of the admission request, the old pod is nil if the
+// request has no old object, e.g. on creation.
+//
+// Requests of both the pods resource and the pods/ephemeralcontainers
+// subresource carry the whole pod as the object.
+func parsePod(request *admissionv1.AdmissionReview) (*corev1.Pod, *corev1.Pod, error) {
 	var (
-		request admissionv1.AdmissionReview
-		pod     = &corev1.Pod{}
+		pod    = &corev1.Pod{}
+		oldPod *corev1.Pod
 	)
 
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		log.Println("Decode body failed.")
-		return nil, nil, fmt.Errorf("could not decode body: %v", err)
+	if kind := request.Request.Kind; kind.Group != "" || kind.Kind != "Pod" {
+		log.Printf("Unexpected object kind %s.", kind.String())
+		return nil, nil, fmt.Errorf("unexpected object kind %s", kind.String())
 	}
 
 	raw := request.Request.Object.Raw
@@ -93,34 +175,52 @@ func parseRequest(r *http.Request) (*admissionv1.AdmissionReview, *corev1.Pod, e
 		return nil, nil, fmt.Errorf("could not unmarshal pod object: %v", err)
 	}
 
-	return &request, pod, nil
+	if raw := request.Request.OldObject.Raw; len(raw) > 0 {
+		oldPod = &corev1.Pod{}
+		if err := json.Unmarshal(raw, oldPod); err != nil {
+			log.Println("Unmarshal old pod object failed.", err.Error())
+			return nil, nil, fmt.Errorf("could not unmarshal old pod object: %v", err)
+		}
+	}
+
+	return pod, oldPod, nil
 }
 
-// patchPod generates the patch for the pod.
-func patchPod(pod *corev1.Pod) ([]byte, error) {
+// patchPod generates the patch for the pod, the old pod is nil on creation.
+// Only the changed image fields are replaced, so that the fields set by other
+// mutating webhooks are kept, and the patch is empty if no image is changed.
+func patchPod(ctx context.Context, pod, oldPod *corev1.Pod, opts *podOptions) ([]byte, error) {
 	// If the pod is controlled by a controller, set podName as generateName.
 	podName := util.ValueIf(pod.Name != "", pod.Name, pod.GenerateName)
 
 	log.Printf("Pod %s/%s is included", pod.Namespace, podName)
 
-	replaceImage(pod)
-
-	var patches = []map[string]any{
-		{
-			"op":    "replace",
-			"path":  "/spec/initContainers",
-			"value": pod.Spec.InitContainers,
-		},
-		{
-			"op":    "replace",
-			"path":  "/spec/containers",
-			"value": pod.Spec.Containers,
-		},
+	patches, originals := replaceImage(ctx, pod, oldPod, opts, false)
+	if len(patches) == 0 {
+		return nil, nil
+	}
+	// image pull secrets are immutable on update
+	var annotations map[string]string
+	if oldPod == nil {
+		patches = append(patches, pullSecretPatches(pod)...)
+		var mirrored []map[string]any
+		mirrored, annotations = mirroredPullSecretPatches(pod, opts, originals)
+		patches = append(patches, mirrored...)
 	}
+	patches = append(patches, recordPatches(pod, originals, annotations)...)
 
 	return json.Marshal(patches)
 }
 
+// replacePatch returns the patch replacing the value of the path
+func replacePatch(path string, value any) map[string]any {
+	return map[string]any{
+		"op":    "replace",
+		"path":  path,
+		"value": value,
+	}
+}
+
 // response sends the response to the admission webhook.
 func response(w http.ResponseWriter, request *admissionv1.AdmissionReview, patchBytes []byte) {
 	response := &admissionv1.AdmissionReview{
@@ -151,46 +251,153 @@ func encodeResponse(w http.ResponseWriter, response *admissionv1.AdmissionReview
 	}
 }
 
-// replaceImage replaces the image in the pod with the proxy image.
-func replaceImage(pod *corev1.Pod) {
+// replaceImage replaces the image in the pod with the proxy image, the old pod
+// is nil on creation. It returns the patches of the replaced images, and the
+// original images of the replaced containers keyed by container name, of the
+// replaced image volumes keyed by volumes/<volume name>, and of the replaced
+// image references keyed by env/<container name>/<env name> and
+// annotations/<annotation key>.
+//
+// On update, only the container images and annotations changed from the old
+// pod are rewritten, e.g. by kubectl set image. The image volumes and environment
+// variables are immutable on pod update and never touched, unless the pod is the
+// pod template of a workload, whose fields are all mutable.
+func replaceImage(ctx context.Context, pod, oldPod *corev1.Pod, opts *podOptions, template bool) ([]map[string]any, map[string]string) {
+	rw := newRewriter(ctx, opts, annotation.OriginalImages(pod))
+	if oldPod != nil {
+		rw.setOld(annotation.OriginalImages(oldPod), mutableImages(oldPod, template))
+	}
+	immutable := oldPod != nil && !template
+	refs := config.GetImageReferences()
+
+	replaceContainer := func(field string, i int, c *corev1.Container) {
+		if opts.skipContainers[c.Name] {
+			return
+		}
+		rw.replace(c.Name, fmt.Sprintf("/spec/%s/%d/image", field, i), &c.Image)
+		if immutable {
+			return
+		}
+		for j := range c.Env {
+			if e := &c.Env[j]; image.Qualified(e.Value) && refs.MatchEnv(e.Name) {
+				rw.replace(envKey(c.Name, e.Name), fmt.Sprintf("/spec/%s/%d/env/%d/value", field, i, j), &e.Value)
+			}
+		}
+	}
+
 	for i := range pod.Spec.InitContainers {
-		pod.Spec.InitContainers[i].Image = getProxyImage(pod.Spec.InitContainers[i].Image)
+		replaceContainer("initContainers", i, &pod.Spec.InitContainers[i])
 	}
 
 	for i := range pod.Spec.Containers {
-		pod.Spec.Containers[i].Image = getProxyImage(pod.Spec.Containers[i].Image)
+		replaceContainer("containers", i, &pod.Spec.Containers[i])
+	}
+
+	// image volumes pull OCI artifacts the same way as container images
+	for i := range pod.Spec.Volumes {
+		if v := pod.Spec.Volumes[i].Image; v != nil && v.Reference != "" && !immutable {
+			rw.replace(imageVolumeKey(pod.Spec.Volumes[i].Name), fmt.Sprintf("/spec/volumes/%d/image/reference", i), &v.Reference)
+		}
+	}
+
+	// annotations holding images, e.g. the sidecar image of a service mesh. Values
+	// of env vars and annotations are rewritten only if they are qualified image
+	// references, other values like true or 1 would parse as Docker Hub images.
+	for _, key := range slices.Sorted(maps.Keys(pod.Annotations)) {
+		if refs.MatchAnnotation(key) && image.Qualified(pod.Annotations[key]) {
+			value := pod.Annotations[key]
+			rw.replace(annotationKey(key), "/metadata/annotations/"+fieldpath.EscapePointer(key), &value)
+			pod.Annotations[key] = value
+		}
 	}
 
-	for i := range pod.Spec.EphemeralContainers {
-		pod.Spec.EphemeralContainers[i].EphemeralContainerCommon.Image = getProxyImage(pod.Spec.EphemeralContainers[i].EphemeralContainerCommon.Image)
+	return rw.patches, rw.originals
+}
+
+// mutableImages returns the images which are mutable on update keyed as the
+// original images, i.e. the images of the init containers and containers and the
+// annotations, and also the image volumes and environment variables of a pod
+// template.
+func mutableImages(pod *corev1.Pod, template bool) map[string]string {
+	images := make(map[string]string)
+	for _, c := range slices.Concat(pod.Spec.InitContainers, pod.Spec.Containers) {
+		images[c.Name] = c.Image
+		if template {
+			for _, e := range c.Env {
+				images[envKey(c.Name, e.Name)] = e.Value
+			}
+		}
+	}
+	if template {
+		for _, v := range pod.Spec.Volumes {
+			if v.Image != nil {
+				images[imageVolumeKey(v.Name)] = v.Image.Reference
+			}
+		}
+	}
+	for key, value := range pod.Annotations {
+		images[annotationKey(key)] = value
 	}
+	return images
+}
+
+// envKey returns the key of the environment variable in the original images
+func envKey(container, name string) string {
+	return "env/" + container + "/" + name
+}
+
+// annotationKey returns the key of the annotation in the original images
+func annotationKey(key string) string {
+	return "annotations/" + key
+}
+
+// imageVolumeKey returns the key of the image volume in the original images,
+// container names never contain "/" so the key never conflicts with them.
+func imageVolumeKey(name string) string {
+	return "volumes/" + name
 }
 
 // getProxyImage gets the proxy image of the raw image.
-func getProxyImage(rawImage string) string {
-	var result = rawImage
-	registry, name, err := image.Parse(rawImage)
+func getProxyImage(ctx context.Context, rawImage string, opts *podOptions) string {
+	ref, expanded, err := opts.profile.ParseImage(rawImage)
 	if err != nil {
 		log.Println("Parse image failed.")
-		return result
+		return rawImage
 	}
 
-	result = path.Join(getProxyRegistry(registry), name)
-	if result != rawImage {
-		log.Printf("Proxy image: %s -> %s", rawImage, result)
+	ref, migrated := config.Canonicalize(ref)
+	result, ok := opts.profile.Rewrite(ref)
+	if mirror, forced := opts.forcedMirror(ref.Registry, ok); forced {
+		result, ok = (&config.Mirror{Host: mirror}).Rewrite(ref), true
+	}
+	if !ok && (expanded || migrated) {
+		// qualify the short name or migrate the legacy registry even if no mirror is configured
+		result, ok = ref.String(), true
+	}
+	if !ok {
+		return rawImage
+	}
+
+	// private images never resolve on mirrors unless the credentials are passed through
+	if p := config.GetPrivateImages(); p.Enabled && !strings.HasPrefix(result, ref.Registry+"/") && config.GetCredentialMirror(result) == "" {
+		if reason := privateReason(ctx, p, ref, opts); reason != "" {
+			log.Printf("Image %s is private, skip: %s", rawImage, reason)
+			return rawImage
+		}
+	}
+
+	// the upstream image is the expanded and canonicalized reference the image is rewritten from
+	upstream := ref.String()
+	if v := config.GetVerify(); v.Enabled && !verifyImage(ctx, v, upstream, result) {
+		return rawImage
 	}
-	return result
-}
 
-// getProxyRegistry gets the proxy registry of the raw registry.
-func getProxyRegistry(rawRegistry string) string {
-	proxies := config.GetProxies()
-	if proxies == nil {
-		return rawRegistry
+	if pin := config.GetPinDigest(); pin.Enabled {
+		result = pinDigest(ctx, pin, upstream, result)
 	}
-	newRegistry := proxies[rawRegistry]
-	if newRegistry == "" {
-		return rawRegistry
+
+	if result != rawImage {
+		log.Printf("Proxy image: %s -> %s", rawImage, result)
 	}
-	return newRegistry
+	return result
 }
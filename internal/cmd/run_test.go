@@ -0,0 +1,256 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/ketches/registry-proxy/internal/annotation"
+	"github.com/ketches/registry-proxy/internal/config"
+	"github.com/ketches/registry-proxy/internal/global"
+	"github.com/ketches/registry-proxy/pkg/kube"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// TestMutate sends the admission review of testdata/mutate/<case>/request.json
+// to the webhook, and compares the patch with testdata/mutate/<case>/patch.json,
+// run with -update to update the golden files.
+func TestMutate(t *testing.T) {
+	config.Reset([]byte(`
+proxies:
+  docker.io: docker.linkos.org
+  ghcr.io:
+    host: ghcr.linkos.org
+    passCredentials: true
+  quay.io:
+    host: quay.mirror.corp
+    pullSecret: quay-credentials
+imageReferences:
+  env:
+  - RELATED_IMAGE_*
+  annotations:
+  - sidecar.istio.io/proxyImage
+rules:
+- match: docker.io/internal/**
+  action: exclude
+workloads: true
+resources:
+- group: tekton.dev
+  version: v1
+  resource: taskruns
+  paths:
+  - .spec.taskSpec.steps[*].image
+  - .spec.taskSpec.sidecars[*].image
+`))
+	defer config.Reset(nil)
+
+	dirs, err := filepath.Glob("testdata/mutate/*")
+	if err != nil || len(dirs) == 0 {
+		t.Fatalf("list test cases failed: %v", err)
+	}
+
+	for _, dir := range dirs {
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			patch := admit(t, filepath.Join(dir, "request.json"))
+
+			golden := filepath.Join(dir, "patch.json")
+			if *update {
+				if err := os.WriteFile(golden, patch, 0644); err != nil {
+					t.Fatalf("update golden file failed: %v", err)
+				}
+				return
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("read golden file failed: %v", err)
+			}
+			if !bytes.Equal(patch, expected) {
+				t.Errorf("mutate failed, expected:\n%s\ngot:\n%s", expected, patch)
+			}
+		})
+	}
+}
+
+// admit sends the admission review in the file to the webhook, and returns the
+// indented patch of the response, which must apply to the object of the review.
+func admit(t *testing.T, file string) []byte {
+	t.Helper()
+
+	body, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("read request failed: %v", err)
+	}
+	w := httptest.NewRecorder()
+	mutate(w, httptest.NewRequest(http.MethodPost, global.WebhookServicePath, bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("mutate failed, status: %d, body: %s", w.Code, w.Body.String())
+	}
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+		t.Fatalf("decode response failed: %v", err)
+	}
+	if review.Response == nil || !review.Response.Allowed {
+		t.Fatalf("mutate should be allowed, got: %s", w.Body.String())
+	}
+	if len(review.Response.Patch) == 0 {
+		return nil
+	}
+
+	var request admissionv1.AdmissionReview
+	json.Unmarshal(body, &request)
+	patch, err := jsonpatch.DecodePatch(review.Response.Patch)
+	if err != nil {
+		t.Fatalf("decode patch failed: %v", err)
+	}
+	if _, err := patch.Apply(request.Request.Object.Raw); err != nil {
+		t.Errorf("apply patch failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	json.Indent(&out, review.Response.Patch, "", "  ")
+	out.WriteByte('\n')
+	return out.Bytes()
+}
+
+// TestReinvocation simulates a sidecar injecting webhook running after ours,
+// the reinvocation only rewrites the injected containers.
+func TestReinvocation(t *testing.T) {
+	// the default mirror would rewrite the mirrors again if rewriting were not idempotent
+	config.Reset([]byte(`
+proxies:
+  docker.io: docker.linkos.org
+default: "{{.RegistryDashed}}.mirror.corp"
+`))
+	defer config.Reset(nil)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "nginx:1.25"}},
+		},
+	}
+
+	pod, patched := invoke(t, pod)
+	if !patched || pod.Spec.Containers[0].Image != "docker.linkos.org/library/nginx:1.25" {
+		t.Fatalf("first invocation failed, got: %+v", pod.Spec.Containers)
+	}
+
+	// the sidecar injector adds containers
+	pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{Name: "istio-init", Image: "docker.io/istio/proxyv2:1.22.0"})
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "istio-proxy", Image: "docker.io/istio/proxyv2:1.22.0"})
+
+	pod, patched = invoke(t, pod)
+	if !patched {
+		t.Fatalf("reinvocation should rewrite the injected containers")
+	}
+	expected := map[string]string{
+		"istio-init":  "docker.linkos.org/istio/proxyv2:1.22.0",
+		"app":         "docker.linkos.org/library/nginx:1.25",
+		"istio-proxy": "docker.linkos.org/istio/proxyv2:1.22.0",
+	}
+	images := mutableImages(pod, false)
+	for name, image := range expected {
+		if images[name] != image {
+			t.Errorf("reinvocation failed, expected image of %s: %s, got: %s", name, image, images[name])
+		}
+	}
+	record := annotation.OriginalImages(pod)
+	if record["app"] != "nginx:1.25" || record["istio-proxy"] != "docker.io/istio/proxyv2:1.22.0" || record["istio-init"] != "docker.io/istio/proxyv2:1.22.0" {
+		t.Errorf("reinvocation failed, unexpected original images: %v", record)
+	}
+
+	if _, patched = invoke(t, pod); patched {
+		t.Errorf("invocation of a proxied pod should not patch")
+	}
+}
+
+// invoke sends the creation of the pod to the webhook, and returns the pod
+// with the patch applied.
+func invoke(t *testing.T, pod *corev1.Pod) (*corev1.Pod, bool) {
+	t.Helper()
+
+	raw, _ := json.Marshal(pod)
+	body, _ := json.Marshal(&admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Namespace: pod.Namespace,
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+	w := httptest.NewRecorder()
+	mutate(w, httptest.NewRequest(http.MethodPost, global.WebhookServicePath, bytes.NewReader(body)))
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil || review.Response == nil {
+		t.Fatalf("decode response failed: %v, body: %s", err, w.Body.String())
+	}
+	if len(review.Response.Patch) == 0 {
+		return pod, false
+	}
+
+	patch, err := jsonpatch.DecodePatch(review.Response.Patch)
+	if err != nil {
+		t.Fatalf("decode patch failed: %v", err)
+	}
+	if raw, err = patch.Apply(raw); err != nil {
+		t.Fatalf("apply patch failed: %v", err)
+	}
+	result := &corev1.Pod{}
+	json.Unmarshal(raw, result)
+	return result, true
+}
+
+func TestWebhookReinvocationPolicy(t *testing.T) {
+	kube.SetClient(fake.NewClientset())
+	defer kube.SetClient(nil)
+	defer config.Reset(nil)
+
+	testdata := []struct {
+		config string
+		policy admissionregistrationv1.ReinvocationPolicyType
+	}{
+		{config: "enabled: true", policy: admissionregistrationv1.IfNeededReinvocationPolicy},
+		{config: "reinvocationPolicy: Never", policy: admissionregistrationv1.NeverReinvocationPolicy},
+		{config: "reinvocationPolicy: IfNeeded", policy: admissionregistrationv1.IfNeededReinvocationPolicy},
+	}
+
+	for _, td := range testdata {
+		config.Reset([]byte(td.config))
+		if got := *constructWebhook().Webhooks[0].ReinvocationPolicy; got != td.policy {
+			t.Errorf("construct webhook with %q failed, expected reinvocation policy: %s, got: %s", td.config, td.policy, got)
+		}
+	}
+}
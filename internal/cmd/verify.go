@@ -0,0 +1,50 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"log"
+
+	"github.com/ketches/registry-proxy/internal/config"
+)
+
+// verifyImage verifies that the rewritten image exists on the mirror, and if
+// matchDigest is set, that its digest matches the one of the upstream reference
+// the image is rewritten from. Images that can not be verified before the
+// deadline are treated as unverified.
+func verifyImage(ctx context.Context, v config.Verify, upstream, rewritten string) bool {
+	digest, err := resolveDigest(ctx, rewritten, v.CacheTTL)
+	if err != nil {
+		log.Printf("Verify image %s failed, keep image %s: %v", rewritten, upstream, err)
+		return false
+	}
+	if !v.MatchDigest {
+		return true
+	}
+
+	upstreamDigest, err := resolveDigest(ctx, upstream, v.CacheTTL)
+	if err != nil {
+		log.Printf("Resolve upstream digest of %s failed, keep image: %v", upstream, err)
+		return false
+	}
+	if digest != upstreamDigest {
+		log.Printf("Digest of %s (%s) mismatches upstream %s (%s), keep image", rewritten, digest, upstream, upstreamDigest)
+		return false
+	}
+	return true
+}
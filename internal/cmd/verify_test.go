@@ -0,0 +1,124 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ketches/registry-proxy/internal/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// resetVerifyConfig configures the mirror of the upstream registry with verify enabled
+func resetVerifyConfig(upstream, mirror *testRegistry, matchDigest bool) {
+	// the upstream registry is configured as a mirror of another registry to trust its certificate
+	config.Reset([]byte(fmt.Sprintf(`
+proxies:
+  %s:
+    host: %s
+    insecureSkipVerify: true
+  registry.test:
+    host: %s
+    insecureSkipVerify: true
+verify:
+  enabled: true
+  matchDigest: %t
+  cacheTTL: 200ms
+`, upstream.host, mirror.host, upstream.host, matchDigest)))
+}
+
+func TestVerifyImage(t *testing.T) {
+	const (
+		digest      = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+		otherDigest = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	)
+	upstream := newTestRegistry(t, map[string]string{"org/app:v1": digest, "org/tool:v1": digest})
+	mirror := newTestRegistry(t, map[string]string{"org/app:v1": digest, "org/tool:v1": otherDigest})
+	defer config.Reset(nil)
+
+	testdata := []struct {
+		matchDigest bool
+		image       string
+		result      string
+	}{
+		// the image verified on the mirror is rewritten
+		{matchDigest: false, image: upstream.host + "/org/app:v1", result: mirror.host + "/org/app:v1"},
+		{matchDigest: true, image: upstream.host + "/org/app:v1", result: mirror.host + "/org/app:v1"},
+		// the image missing on the mirror is kept
+		{matchDigest: false, image: upstream.host + "/org/missing:v1", result: upstream.host + "/org/missing:v1"},
+		// the image whose digest mismatches the upstream one is kept
+		{matchDigest: false, image: upstream.host + "/org/tool:v1", result: mirror.host + "/org/tool:v1"},
+		{matchDigest: true, image: upstream.host + "/org/tool:v1", result: upstream.host + "/org/tool:v1"},
+	}
+	for _, td := range testdata {
+		resetVerifyConfig(upstream, mirror, td.matchDigest)
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: td.image}}},
+		}
+		pod, _ = invoke(t, pod)
+		if result := pod.Spec.Containers[0].Image; result != td.result {
+			t.Errorf("verify %s with matchDigest %t failed, expected: %s, got: %s", td.image, td.matchDigest, td.result, result)
+		}
+	}
+}
+
+func TestVerifyImageCache(t *testing.T) {
+	upstream := newTestRegistry(t, nil)
+	mirror := newTestRegistry(t, nil)
+	mirror.delay = 50 * time.Millisecond
+	resetVerifyConfig(upstream, mirror, false)
+	defer config.Reset(nil)
+
+	v := config.GetVerify()
+	rewritten := mirror.host + "/org/missing:v1"
+	verify := func() bool {
+		return verifyImage(context.Background(), v, upstream.host+"/org/missing:v1", rewritten)
+	}
+
+	// concurrent verifications of the same image are deduplicated
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if verify() {
+				t.Errorf("image missing on the mirror should not be verified")
+			}
+		}()
+	}
+	wg.Wait()
+	if requests := mirror.requests.Load(); requests != 1 {
+		t.Errorf("concurrent verifications should request the mirror once, got %d requests", requests)
+	}
+
+	// the negative result is cached for cacheTTL
+	verify()
+	if requests := mirror.requests.Load(); requests != 1 {
+		t.Errorf("negative result should be cached, got %d requests", requests)
+	}
+	time.Sleep(v.CacheTTL)
+	verify()
+	if requests := mirror.requests.Load(); requests != 2 {
+		t.Errorf("negative result should expire after cacheTTL, got %d requests", requests)
+	}
+}
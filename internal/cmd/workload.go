@@ -0,0 +1,144 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ketches/registry-proxy/internal/config"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// workloadTemplatePaths is the field paths of the pod templates of the workload resources
+var workloadTemplatePaths = map[metav1.GroupVersionResource][]string{
+	{Group: "apps", Version: "v1", Resource: "deployments"}:  {"spec", "template"},
+	{Group: "apps", Version: "v1", Resource: "statefulsets"}: {"spec", "template"},
+	{Group: "apps", Version: "v1", Resource: "daemonsets"}:   {"spec", "template"},
+	{Group: "apps", Version: "v1", Resource: "replicasets"}:  {"spec", "template"},
+	{Group: "batch", Version: "v1", Resource: "jobs"}:        {"spec", "template"},
+	{Group: "batch", Version: "v1", Resource: "cronjobs"}:    {"spec", "jobTemplate", "spec", "template"},
+}
+
+// mutateWorkload mutates the pod template of the workload of the admission
+// request if the profile selected by the namespace rewrites workloads. The pod
+// template is rewritten the same way as pods, and the original images are
+// recorded on the pod template, so that the pods created from the template are
+// not rewritten again.
+func mutateWorkload(ctx context.Context, w http.ResponseWriter, request *admissionv1.AdmissionReview, templatePath []string) {
+	obj, oldObj, err := parseObject(request)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not parse request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	template, found, _ := unstructured.NestedMap(obj.Object, templatePath...)
+	if !found || obj.GetDeletionTimestamp() != nil {
+		response(w, request, nil)
+		return
+	}
+	pod, err := templatePod(template)
+	if err != nil {
+		log.Println("Convert pod template failed.", err.Error())
+		http.Error(w, fmt.Sprintf("could not convert pod template: %v", err), http.StatusBadRequest)
+		return
+	}
+	var oldPod *corev1.Pod
+	if oldObj != nil {
+		if oldTemplate, found, _ := unstructured.NestedMap(oldObj.Object, templatePath...); found {
+			oldPod, _ = templatePod(oldTemplate)
+		}
+	}
+
+	// If the pod template not match the pod selector, return directly.
+	if selector := config.PodSelector().AsSelector(); !selector.Empty() {
+		if !selector.Matches(labels.Set(pod.Labels)) {
+			response(w, request, nil)
+			return
+		}
+	}
+
+	opts := parsePodOptions(pod.Annotations, request.Request.Namespace)
+	if !opts.profile.Workloads || opts.skip {
+		response(w, request, nil)
+		return
+	}
+	if config.GetPrivateImages().Enabled {
+		opts.credentials = sync.OnceValue(func() []string {
+			return podCredentials(pod, request.Request.Namespace)
+		})
+	}
+
+	patches, originals := replaceImage(ctx, pod, oldPod, opts, true)
+	if len(patches) == 0 {
+		response(w, request, nil)
+		return
+	}
+	log.Printf("%s %s/%s is included", obj.GetKind(), obj.GetNamespace(), objectName(obj))
+
+	patches = append(patches, pullSecretPatches(pod)...)
+	mirrored, annotations := mirroredPullSecretPatches(pod, opts, originals)
+	patches = append(patches, mirrored...)
+	patches = append(patches, recordPatches(pod, originals, annotations)...)
+	patchBytes, err := json.Marshal(templatePatches(template, templatePath, patches))
+	if err != nil {
+		log.Println("Marshal patch failed.")
+		http.Error(w, fmt.Sprintf("could not marshal patch: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response(w, request, patchBytes)
+}
+
+// templatePod converts the pod template to a pod
+func templatePod(template map[string]any) (*corev1.Pod, error) {
+	var spec corev1.PodTemplateSpec
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(template, &spec); err != nil {
+		return nil, err
+	}
+	return &corev1.Pod{ObjectMeta: spec.ObjectMeta, Spec: spec.Spec}, nil
+}
+
+// templatePatches relocates the patches of the pod to the pod template at the
+// path, the metadata of the template is added first if absent.
+func templatePatches(template map[string]any, templatePath []string, patches []map[string]any) []map[string]any {
+	prefix := "/" + strings.Join(templatePath, "/")
+
+	var result []map[string]any
+	if _, ok := template["metadata"].(map[string]any); !ok {
+		result = append(result, map[string]any{
+			"op":    "add",
+			"path":  prefix + "/metadata",
+			"value": map[string]any{},
+		})
+	}
+	for _, patch := range patches {
+		patch["path"] = prefix + patch["path"].(string)
+		result = append(result, patch)
+	}
+	return result
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+
+	"github.com/ketches/registry-proxy/pkg/image"
+)
+
+// builtinAliases is the built-in map of registry alias and canonical registry
+var builtinAliases = map[string]string{
+	"index.docker.io":         "docker.io",
+	"registry-1.docker.io":    "docker.io",
+	"registry.hub.docker.com": "docker.io",
+}
+
+// Canonicalize canonicalizes the registry of the image reference, aliases are
+// resolved first and then migrations. migrated reports whether the registry is
+// migrated to its successor, in which case the image should be rewritten to the
+// result even if no mirror is configured.
+func Canonicalize(ref *image.Reference) (result *image.Reference, migrated bool) {
+	result = ref
+	if canonical := CanonicalRegistry(ref.Registry); canonical != ref.Registry {
+		result = result.WithRegistry(canonical)
+	}
+
+	if successor, ok := configInstance.Migrations[result.Registry]; ok {
+		return result.WithRegistry(successor), true
+	}
+	return result, false
+}
+
+// CanonicalRegistry resolves the registry alias to its canonical registry, the
+// registry itself is returned if it is not an alias.
+func CanonicalRegistry(registry string) string {
+	if canonical, ok := configInstance.Aliases[registry]; ok {
+		return canonical
+	}
+	if canonical, ok := builtinAliases[registry]; ok {
+		return canonical
+	}
+	return registry
+}
+
+// validateRegistryMap validates the map of registries, keys and values must be
+// different non-empty registries.
+func validateRegistryMap(m map[string]string) error {
+	for from, to := range m {
+		if from == "" || to == "" {
+			return fmt.Errorf("registry must not be empty")
+		}
+		if from == to {
+			return fmt.Errorf("registry %s is mapped to itself", from)
+		}
+		if err := validateRegistry(to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateRegistry validates the registry domain, e.g. registry.k8s.io
+func validateRegistry(registry string) error {
+	if r, _, err := image.Parse(registry + "/sample"); err != nil || r != registry {
+		return fmt.Errorf("invalid registry %q", registry)
+	}
+	return nil
+}
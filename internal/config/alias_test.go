@@ -0,0 +1,76 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/ketches/registry-proxy/pkg/image"
+)
+
+func TestCanonicalize(t *testing.T) {
+	Reset([]byte(`
+aliases:
+  mirror.gcr.io: docker.io
+migrations:
+  k8s.gcr.io: registry.k8s.io
+`))
+	defer Reset(nil)
+
+	testdata := []struct {
+		image    string
+		result   string
+		migrated bool
+	}{
+		{image: "registry-1.docker.io/nginx:1.25", result: "docker.io/library/nginx:1.25"},
+		{image: "registry.hub.docker.com/username/image:tag", result: "docker.io/username/image:tag"},
+		{image: "index.docker.io/library/nginx", result: "docker.io/library/nginx:latest"},
+		{image: "mirror.gcr.io/redis", result: "docker.io/library/redis:latest"},
+		{image: "quay.io/username/image:tag", result: "quay.io/username/image:tag"},
+		{image: "k8s.gcr.io/pause:3.9", result: "registry.k8s.io/pause:3.9", migrated: true},
+	}
+
+	for _, td := range testdata {
+		ref, err := image.ParseReference(td.image)
+		if err != nil {
+			t.Fatalf("parse image %s failed: %v", td.image, err)
+		}
+		result, migrated := Canonicalize(ref)
+		if result.String() != td.result || migrated != td.migrated {
+			t.Errorf("canonicalize %s failed, expected: %s %v, got: %s %v", td.image, td.result, td.migrated, result.String(), migrated)
+		}
+	}
+}
+
+func TestValidateRegistryMap(t *testing.T) {
+	testdata := []struct {
+		m     map[string]string
+		valid bool
+	}{
+		{m: map[string]string{"k8s.gcr.io": "registry.k8s.io"}, valid: true},
+		{m: map[string]string{"k8s.gcr.io": ""}, valid: false},
+		{m: map[string]string{"docker.io": "docker.io"}, valid: false},
+		{m: map[string]string{"k8s.gcr.io": "registry.k8s.io/"}, valid: false},
+	}
+
+	for _, td := range testdata {
+		err := validateRegistryMap(td.m)
+		if (err == nil) != td.valid {
+			t.Errorf("validate %v failed, expected valid: %v, got error: %v", td.m, td.valid, err)
+		}
+	}
+}
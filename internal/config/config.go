@@ -17,9 +17,13 @@ limitations under the License.
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"log"
 
 	"github.com/ketches/registry-proxy/pkg/util"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	"k8s.io/apimachinery/pkg/labels"
 )
 
@@ -27,8 +31,16 @@ import (
 type config struct {
 	// Enabled is the flag to enable the registry proxy
 	Enabled bool `yaml:"enabled"`
-	// Proxies is the map of registry domain and proxy domain
-	Proxies map[string]string `yaml:"proxies"`
+	// Profile is the default profile of proxies and rules
+	Profile `yaml:",inline"`
+	// Profiles is the named profiles selected by namespaces
+	Profiles map[string]Profile `yaml:"profiles,omitempty"`
+	// Aliases is the map of registry alias and canonical registry, merged over the
+	// built-in aliases of docker.io, registries are canonicalized before matching
+	Aliases map[string]string `yaml:"aliases,omitempty"`
+	// Migrations is the map of legacy registry and its successor, images of legacy
+	// registries are rewritten to the successor even if no mirror is configured
+	Migrations map[string]string `yaml:"migrations,omitempty"`
 	// ExcludeNamespaces is the list of namespaces that will not be proxied
 	ExcludeNamespaces []string `yaml:"excludeNamespaces"`
 	// IncludeNamespaces is the list of namespaces that will be proxied
@@ -37,19 +49,40 @@ type config struct {
 	PodSelector labels.Set `yaml:"podSelector"`
 	// NamespaceSelector is the selector to select the namespaces that will be proxied
 	NamespaceSelector labels.Set `yaml:"namespaceSelector"`
+	// Resources is the resources out of pods holding images, e.g. custom resources
+	Resources []Resource `yaml:"resources,omitempty"`
+	// ReinvocationPolicy is the reinvocation policy of the webhook, Never or IfNeeded,
+	// IfNeeded by default so that containers injected by later webhooks are proxied
+	ReinvocationPolicy admissionregistrationv1.ReinvocationPolicyType `yaml:"reinvocationPolicy,omitempty"`
+	// ImageReferences is the config of image references in environment variables
+	// and annotations of pods
+	ImageReferences ImageReferences `yaml:"imageReferences,omitempty"`
+	// PinDigest is the config of pinning rewritten image tags to manifest digests
+	PinDigest PinDigest `yaml:"pinDigest,omitempty"`
+	// Verify is the config of verifying rewritten images exist on mirrors
+	Verify Verify `yaml:"verify,omitempty"`
+	// PrivateImages is the config of skipping private images
+	PrivateImages PrivateImages `yaml:"privateImages,omitempty"`
+	// Fallback is the config of falling back from the mirrors failed to pull images
+	Fallback Fallback `yaml:"fallback,omitempty"`
+	// HealthCheck is the config of the active health check of mirrors,
+	// it can be overridden per mirror
+	HealthCheck HealthCheck `yaml:"healthCheck,omitempty"`
 }
 
-var defaultProxies = map[string]string{
-	"docker.io":       "docker.linkos.org",
-	"registry.k8s.io": "k8s.linkos.org",
-	"quay.io":         "quay.linkos.org",
-	"ghcr.io":         "ghcr.linkos.org",
-	"gcr.io":          "gcr.linkos.org",
+var defaultProxies = map[string]Mirrors{
+	"docker.io":       {{Host: "docker.linkos.org"}},
+	"registry.k8s.io": {{Host: "k8s.linkos.org"}},
+	"quay.io":         {{Host: "quay.linkos.org"}},
+	"ghcr.io":         {{Host: "ghcr.linkos.org"}},
+	"gcr.io":          {{Host: "gcr.linkos.org"}},
 }
 
 var defaultConfig = config{
 	Enabled: true,
-	Proxies: defaultProxies,
+	Profile: Profile{
+		Proxies: defaultProxies,
+	},
 	ExcludeNamespaces: []string{
 		"kube-system",
 		"kube-public",
@@ -66,16 +99,34 @@ var defaultConfig = config{
 // configInstance is the singleton config instance
 var configInstance = &defaultConfig
 
+// generation is the short hash of the singleton config instance, it identifies
+// the config that produced a rewrite
+var generation string
+
+func init() {
+	updateGeneration()
+}
+
 // Get get the singleton config instance
 func Get() *config {
 	return configInstance
 }
 
 // GetProxies get the singleton config instance's proxies
-func GetProxies() map[string]string {
+func GetProxies() map[string]Mirrors {
 	return configInstance.Proxies
 }
 
+// GetRules get the singleton config instance's rules
+func GetRules() []Rule {
+	return configInstance.Rules
+}
+
+// GetGeneration get the generation of the singleton config instance
+func GetGeneration() string {
+	return generation
+}
+
 // GetExcludeNamespaces get the singleton config instance's excludeNamespaces
 func GetExcludeNamespaces() []string {
 	return configInstance.ExcludeNamespaces
@@ -91,6 +142,12 @@ func Enabled() bool {
 	return configInstance.Enabled
 }
 
+// ReinvocationPolicy get the singleton config instance's reinvocation policy,
+// IfNeeded if not set
+func ReinvocationPolicy() admissionregistrationv1.ReinvocationPolicyType {
+	return util.ValueIf(configInstance.ReinvocationPolicy != "", configInstance.ReinvocationPolicy, admissionregistrationv1.IfNeededReinvocationPolicy)
+}
+
 // PodSelector get the singleton config instance's pod selector
 func PodSelector() labels.Set {
 	return configInstance.PodSelector
@@ -105,18 +162,88 @@ func NamespaceSelector() labels.Set {
 // If in is empty, reset to default config
 func Reset(in []byte) {
 	if len(in) > 0 {
-		configInstance = &config{} // reset to empty config
-		err := util.UnmarshalYAML(in, configInstance)
-		if err != nil {
-			log.Printf("Reset config failed: %v", err)
+		newConfig := &config{} // reset to empty config
+		if err := util.UnmarshalYAML(in, newConfig); err != nil {
+			log.Printf("Reset config failed, keep current config: %v", err)
+			return
 		}
+		if err := newConfig.validate(); err != nil {
+			log.Printf("Validate config failed, keep current config: %v", err)
+			return
+		}
+		configInstance = newConfig
 	} else {
 		// reset to default config
 		configInstance = &defaultConfig
 	}
+	resetDefaultMirrors()
+	updateGeneration()
 	printCurrentConfig()
 }
 
+// validate validates the config
+func (c *config) validate() error {
+	switch c.ReinvocationPolicy {
+	case "", admissionregistrationv1.NeverReinvocationPolicy, admissionregistrationv1.IfNeededReinvocationPolicy:
+	default:
+		return fmt.Errorf("invalid reinvocationPolicy %q, must be Never or IfNeeded", c.ReinvocationPolicy)
+	}
+	if err := c.HealthCheck.validate(); err != nil {
+		return fmt.Errorf("healthCheck: %v", err)
+	}
+	if err := c.Profile.validate(); err != nil {
+		return err
+	}
+	for name, profile := range c.Profiles {
+		if err := profile.validate(); err != nil {
+			return fmt.Errorf("profiles[%s]: %v", name, err)
+		}
+		c.Profiles[name] = profile
+	}
+
+	if err := validateRegistryMap(c.Aliases); err != nil {
+		return fmt.Errorf("aliases: %v", err)
+	}
+	if err := validateRegistryMap(c.Migrations); err != nil {
+		return fmt.Errorf("migrations: %v", err)
+	}
+
+	for i := range c.Resources {
+		if err := c.Resources[i].validate(); err != nil {
+			return fmt.Errorf("resources[%d]: %v", i, err)
+		}
+	}
+
+	if err := c.ImageReferences.validate(); err != nil {
+		return fmt.Errorf("imageReferences: %v", err)
+	}
+
+	if err := c.PinDigest.validate(); err != nil {
+		return fmt.Errorf("pinDigest: %v", err)
+	}
+	if err := c.Verify.validate(); err != nil {
+		return fmt.Errorf("verify: %v", err)
+	}
+	if err := c.PrivateImages.validate(); err != nil {
+		return fmt.Errorf("privateImages: %v", err)
+	}
+	if err := c.Fallback.validate(); err != nil {
+		return fmt.Errorf("fallback: %v", err)
+	}
+	return nil
+}
+
+// updateGeneration updates the generation to the hash of the current config
+func updateGeneration() {
+	out, err := util.MarshalYAML(configInstance)
+	if err != nil {
+		log.Printf("Marshal config failed: %v", err)
+		return
+	}
+	sum := sha256.Sum256(out)
+	generation = hex.EncodeToString(sum[:])[:12]
+}
+
 // printCurrentConfig print current config
 func printCurrentConfig() {
 	out, err := util.MarshalYAML(configInstance)
@@ -124,5 +251,5 @@ func printCurrentConfig() {
 		log.Printf("Marshal config failed: %v", err)
 		return
 	}
-	log.Printf("Current registry proxy config: \n%s", string(out))
+	log.Printf("Current registry proxy config (generation %s): \n%s", generation, string(out))
 }
@@ -0,0 +1,62 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ketches/registry-proxy/pkg/util"
+)
+
+// Fallback is the config of falling back from the mirrors which the rewritten
+// images of pods failed to be pulled from
+type Fallback struct {
+	// Enabled is the flag to fall back when containers of rewritten pods are stuck
+	// in ErrImagePull or ImagePullBackOff
+	Enabled bool `yaml:"enabled"`
+	// After is how long a container is stuck before falling back, default is 2m
+	After time.Duration `yaml:"after,omitempty"`
+	// FailureTTL is how long the mirror is skipped for the failed image, default is 1h
+	FailureTTL time.Duration `yaml:"failureTTL,omitempty"`
+	// MaxRetries is the max number of pods deleted per workload within the failure
+	// TTL, default is 3
+	MaxRetries int `yaml:"maxRetries,omitempty"`
+}
+
+const (
+	defaultFallbackAfter      = 2 * time.Minute
+	defaultFallbackFailureTTL = time.Hour
+	defaultFallbackMaxRetries = 3
+)
+
+// validate validates the fallback config
+func (f *Fallback) validate() error {
+	if f.After < 0 || f.FailureTTL < 0 || f.MaxRetries < 0 {
+		return fmt.Errorf("after, failureTTL and maxRetries must not be negative")
+	}
+	return nil
+}
+
+// GetFallback get the singleton config instance's fallback with defaults applied
+func GetFallback() Fallback {
+	f := configInstance.Fallback
+	f.After = util.ValueIf(f.After > 0, f.After, defaultFallbackAfter)
+	f.FailureTTL = util.ValueIf(f.FailureTTL > 0, f.FailureTTL, defaultFallbackFailureTTL)
+	f.MaxRetries = util.ValueIf(f.MaxRetries > 0, f.MaxRetries, defaultFallbackMaxRetries)
+	return f
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ketches/registry-proxy/internal/health"
+	"github.com/ketches/registry-proxy/pkg/util"
+)
+
+const (
+	defaultHealthCheckInterval         = 30 * time.Second
+	defaultHealthCheckTimeout          = 5 * time.Second
+	defaultHealthCheckFailureThreshold = 3
+)
+
+// HealthCheck is the config of the active health check of mirrors
+type HealthCheck struct {
+	// Enabled is the flag to probe `GET /v2/` of the mirrors periodically
+	Enabled *bool `yaml:"enabled,omitempty"`
+	// Interval is the interval of probes, default is 30s
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Timeout is the timeout of a probe, default is 5s
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// FailureThreshold is the number of consecutive failed probes to mark a mirror unhealthy, default is 3
+	FailureThreshold int `yaml:"failureThreshold,omitempty"`
+}
+
+// merge returns the health check overridden by the set fields of override
+func (hc HealthCheck) merge(override *HealthCheck) HealthCheck {
+	if override == nil {
+		return hc
+	}
+	if override.Enabled != nil {
+		hc.Enabled = override.Enabled
+	}
+	hc.Interval = util.ValueIf(override.Interval > 0, override.Interval, hc.Interval)
+	hc.Timeout = util.ValueIf(override.Timeout > 0, override.Timeout, hc.Timeout)
+	hc.FailureThreshold = util.ValueIf(override.FailureThreshold > 0, override.FailureThreshold, hc.FailureThreshold)
+	return hc
+}
+
+// validate validates the health check
+func (hc *HealthCheck) validate() error {
+	if hc == nil {
+		return nil
+	}
+	if hc.Interval < 0 || hc.Timeout < 0 || hc.FailureThreshold < 0 {
+		return fmt.Errorf("interval, timeout and failureThreshold must not be negative")
+	}
+	return nil
+}
+
+// GetHealthCheckTargets gets the health check targets of all mirrors in the
+// singleton config instance, including the mirrors rendered by the default
+// templates so far. Mirrors sharing a hostname are probed once with the settings
+// of the first one.
+func GetHealthCheckTargets() []health.Target {
+	var (
+		targets []health.Target
+		seen    = make(map[string]bool)
+	)
+	add := func(m *Mirror) {
+		if target, ok := healthCheckTarget(m); ok && !seen[target.Host] {
+			seen[target.Host] = true
+			targets = append(targets, target)
+		}
+	}
+
+	for _, mirrors := range configInstance.allMirrors() {
+		for i := range mirrors {
+			add(&mirrors[i])
+		}
+	}
+	defaultMirrorsMu.Lock()
+	defer defaultMirrorsMu.Unlock()
+	for _, host := range slices.Sorted(maps.Keys(defaultMirrors)) {
+		add(&Mirror{Host: host})
+	}
+	return targets
+}
+
+// healthCheckTarget returns the health check target of the mirror, ok is false
+// if the health check of the mirror is disabled.
+func healthCheckTarget(m *Mirror) (target health.Target, ok bool) {
+	hc := configInstance.HealthCheck.merge(m.HealthCheck)
+	if hc.Enabled == nil || !*hc.Enabled {
+		return target, false
+	}
+	return health.Target{
+		Host:               m.Hostname(),
+		Interval:           util.ValueIf(hc.Interval > 0, hc.Interval, defaultHealthCheckInterval),
+		Timeout:            util.ValueIf(hc.Timeout > 0, hc.Timeout, defaultHealthCheckTimeout),
+		FailureThreshold:   util.ValueIf(hc.FailureThreshold > 0, hc.FailureThreshold, defaultHealthCheckFailureThreshold),
+		CABundle:           m.CABundle,
+		InsecureSkipVerify: m.InsecureSkipVerify,
+	}, true
+}
+
+var (
+	defaultMirrorsMu sync.Mutex
+	// defaultMirrors is the hosts of the mirrors rendered by the default templates
+	// of the current config, they are known only once rendered
+	defaultMirrors = make(map[string]bool)
+)
+
+// observeDefaultMirror records the mirror rendered by a default template, and
+// starts probing it the first time it is rendered.
+func observeDefaultMirror(m *Mirror) {
+	defaultMirrorsMu.Lock()
+	observed := defaultMirrors[m.Host]
+	defaultMirrors[m.Host] = true
+	defaultMirrorsMu.Unlock()
+	if target, ok := healthCheckTarget(m); ok && !observed {
+		health.AddTarget(target)
+	}
+}
+
+// isMirrorHostname reports whether the registry is the hostname of a mirror in
+// the singleton config instance, including the mirrors rendered by the default
+// templates so far.
+func isMirrorHostname(registry string) bool {
+	for _, mirrors := range configInstance.allMirrors() {
+		for i := range mirrors {
+			if mirrors[i].Hostname() == registry {
+				return true
+			}
+		}
+	}
+	for _, profile := range configInstance.allProfiles() {
+		for i := range profile.Rules {
+			if hostname := profile.Rules[i].outputHostname(); hostname != "" && hostname == registry {
+				return true
+			}
+		}
+	}
+	defaultMirrorsMu.Lock()
+	defer defaultMirrorsMu.Unlock()
+	for host := range defaultMirrors {
+		if (&Mirror{Host: host}).Hostname() == registry {
+			return true
+		}
+	}
+	return false
+}
+
+// resetDefaultMirrors forgets the mirrors rendered by the default templates of the previous config
+func resetDefaultMirrors() {
+	defaultMirrorsMu.Lock()
+	defer defaultMirrorsMu.Unlock()
+	clear(defaultMirrors)
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"cmp"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/ketches/registry-proxy/internal/global"
+	"github.com/ketches/registry-proxy/internal/health"
+	"github.com/ketches/registry-proxy/pkg/image"
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Mirror is a registry mirror, it is configured as a plain host string, or as
+// an object to customize how the rewritten image is rendered.
+type Mirror struct {
+	// Host is the address of the mirror, may contain a path prefix, e.g. harbor.corp/dockerhub
+	Host string `yaml:"host"`
+	// OfficialImagePrefix is the repository prefix of Docker Hub official images on the mirror.
+	// Unset keeps the library prefix, empty renders the short form, e.g. nginx.
+	OfficialImagePrefix *string `yaml:"officialImagePrefix,omitempty"`
+	// OmitImplicitTag omits the implicit latest tag on the rewritten image
+	OmitImplicitTag bool `yaml:"omitImplicitTag,omitempty"`
+	// Priority is the priority of the mirror in a mirror list, lower is preferred, default is 0
+	Priority int `yaml:"priority,omitempty"`
+	// HealthCheck overrides the global health check settings for the mirror
+	HealthCheck *HealthCheck `yaml:"healthCheck,omitempty"`
+	// CABundle is the PEM encoded CA certificates to trust when connecting to the mirror
+	CABundle string `yaml:"caBundle,omitempty"`
+	// InsecureSkipVerify skips the verification of the mirror's certificate
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify,omitempty"`
+	// PullSecret is the name of the dockerconfigjson Secret in the registry-proxy
+	// namespace holding the credentials of the mirror, it is replicated to the
+	// namespaces of the pods rewritten to the mirror
+	PullSecret string `yaml:"pullSecret,omitempty"`
+	// PassCredentials duplicates the credentials of the original registry in the
+	// image pull secrets of the pod under the mirror host, for mirrors passing the
+	// credentials through to the original registry
+	PassCredentials bool `yaml:"passCredentials,omitempty"`
+}
+
+// UnmarshalYAML unmarshals the mirror from a host string or an object
+func (m *Mirror) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*m = Mirror{Host: value.Value}
+		return nil
+	}
+	type plain Mirror
+	return value.Decode((*plain)(m))
+}
+
+// MarshalYAML marshals the mirror as a host string if no option is set
+func (m Mirror) MarshalYAML() (any, error) {
+	if m == (Mirror{Host: m.Host}) {
+		return m.Host, nil
+	}
+	type plain Mirror
+	return plain(m), nil
+}
+
+// Rewrite rewrites the image reference to the mirror.
+func (m *Mirror) Rewrite(ref *image.Reference) string {
+	return path.Join(m.Host, ref.Name(image.RenderOptions{
+		OfficialPrefix:  m.OfficialImagePrefix,
+		OmitImplicitTag: m.OmitImplicitTag,
+	}))
+}
+
+// Hostname returns the hostname of the mirror without path prefix.
+func (m *Mirror) Hostname() string {
+	hostname, _, _ := strings.Cut(m.Host, "/")
+	return hostname
+}
+
+// Mirrors is the failover list of mirrors of a registry, it is configured as
+// a single mirror or a list of mirrors.
+type Mirrors []Mirror
+
+// UnmarshalYAML unmarshals the mirrors from a single mirror or a list
+func (ms *Mirrors) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.SequenceNode {
+		var m Mirror
+		if err := value.Decode(&m); err != nil {
+			return err
+		}
+		*ms = Mirrors{m}
+		return nil
+	}
+	return value.Decode((*[]Mirror)(ms))
+}
+
+// MarshalYAML marshals the mirrors as a single mirror if there is only one
+func (ms Mirrors) MarshalYAML() (any, error) {
+	if len(ms) == 1 {
+		return ms[0], nil
+	}
+	return []Mirror(ms), nil
+}
+
+// validate validates the mirrors
+func (ms Mirrors) validate() error {
+	for i := range ms {
+		if ms[i].Host == "" {
+			return fmt.Errorf("host of mirror %d is required", i)
+		}
+		if err := ms[i].HealthCheck.validate(); err != nil {
+			return fmt.Errorf("health check of mirror %s: %v", ms[i].Host, err)
+		}
+		if name := ms[i].PullSecret; name != "" {
+			if errs := validation.IsDNS1123Subdomain(global.PullSecretPrefix + name); len(errs) > 0 {
+				return fmt.Errorf("pull secret of mirror %s: invalid name %q: %s", ms[i].Host, name, strings.Join(errs, ", "))
+			}
+			// the replica would collide with the pull secrets derived for passCredentials
+			if strings.HasPrefix(global.PullSecretPrefix+name, global.MirroredPullSecretPrefix) {
+				return fmt.Errorf("pull secret of mirror %s: name %q must not start with %q", ms[i].Host, name, strings.TrimPrefix(global.MirroredPullSecretPrefix, global.PullSecretPrefix))
+			}
+		}
+	}
+	return nil
+}
+
+// Select selects the healthy mirror with the highest priority, mirrors with the
+// same priority are selected in list order. It returns nil if there is no healthy
+// mirror, in which case the image is kept on the original registry.
+func (ms Mirrors) Select() *Mirror {
+	sorted := slices.Clone(ms)
+	slices.SortStableFunc(sorted, func(a, b Mirror) int {
+		return cmp.Compare(a.Priority, b.Priority)
+	})
+	for i := range sorted {
+		if health.IsHealthy(sorted[i].Hostname()) {
+			return &sorted[i]
+		}
+	}
+	return nil
+}
+
+// Rewrite rewrites the image reference to the selected mirror. ok is false if
+// there is no mirror, or the selected mirror is the registry of the image itself,
+// which is how falling back to the original registry is configured. Mirrors the
+// image is marked failed on are skipped, if the image is marked failed on all
+// mirrors it falls back to the original registry.
+func (ms Mirrors) Rewrite(ref *image.Reference) (result string, ok bool) {
+	var available Mirrors
+	for i := range ms {
+		if !health.IsImageFailed(ms[i].Rewrite(ref)) {
+			available = append(available, ms[i])
+		}
+	}
+	mirror := available.Select()
+	if mirror == nil || mirror.Host == "" || mirror.Host == ref.Registry {
+		return "", false
+	}
+	return mirror.Rewrite(ref), true
+}
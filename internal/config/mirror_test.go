@@ -0,0 +1,164 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ketches/registry-proxy/internal/health"
+	"github.com/ketches/registry-proxy/pkg/image"
+	"github.com/ketches/registry-proxy/pkg/util"
+)
+
+func TestMirrorOptions(t *testing.T) {
+	Reset([]byte(`
+proxies:
+  docker.io:
+    host: registry.cn-hangzhou.aliyuncs.com
+    officialImagePrefix: ""
+    omitImplicitTag: true
+  quay.io: quay.linkos.org
+`))
+	defer Reset(nil)
+
+	testdata := []struct {
+		image  string
+		result string
+	}{
+		{image: "nginx", result: "registry.cn-hangzhou.aliyuncs.com/nginx"},
+		{image: "nginx:1.25", result: "registry.cn-hangzhou.aliyuncs.com/nginx:1.25"},
+		{image: "username/image", result: "registry.cn-hangzhou.aliyuncs.com/username/image"},
+		{image: "quay.io/username/image", result: "quay.linkos.org/username/image:latest"},
+	}
+
+	for _, td := range testdata {
+		ref, _ := image.ParseReference(td.image)
+		if result, _ := Rewrite(ref); result != td.result {
+			t.Errorf("rewrite %s failed, expected: %s, got: %s", td.image, td.result, result)
+		}
+	}
+
+	out, err := util.MarshalYAML(GetProxies())
+	if err != nil {
+		t.Fatalf("marshal proxies failed: %v", err)
+	}
+	if !strings.Contains(string(out), "quay.io: quay.linkos.org\n") {
+		t.Errorf("mirror without options should be marshaled as host string, got:\n%s", out)
+	}
+}
+
+func TestMirrorsFailover(t *testing.T) {
+	Reset([]byte(`
+proxies:
+  docker.io:
+  - docker.linkos.org
+  - host: mirror.corp/dockerhub
+    priority: 1
+  - host: docker.io
+    priority: 2
+  quay.io:
+  - host: quay-backup.corp
+    priority: 1
+  - quay.linkos.org
+`))
+	defer Reset(nil)
+
+	rewrite := func(s string) string {
+		ref, _ := image.ParseReference(s)
+		result, ok := Rewrite(ref)
+		if !ok {
+			return s
+		}
+		return result
+	}
+
+	if result := rewrite("nginx"); result != "docker.linkos.org/library/nginx:latest" {
+		t.Errorf("expected the first mirror, got: %s", result)
+	}
+	if result := rewrite("quay.io/username/image:tag"); result != "quay.linkos.org/username/image:tag" {
+		t.Errorf("expected the mirror with the highest priority, got: %s", result)
+	}
+
+	health.MarkUnhealthy("docker.linkos.org")
+	defer health.MarkHealthy("docker.linkos.org")
+	if result := rewrite("nginx"); result != "mirror.corp/dockerhub/library/nginx:latest" {
+		t.Errorf("expected the next healthy mirror, got: %s", result)
+	}
+
+	health.MarkUnhealthy("mirror.corp")
+	defer health.MarkHealthy("mirror.corp")
+	if result := rewrite("nginx"); result != "nginx" {
+		t.Errorf("expected falling back to the original registry, got: %s", result)
+	}
+
+	health.MarkUnhealthy("docker.io")
+	defer health.MarkHealthy("docker.io")
+	if result := rewrite("nginx"); result != "nginx" {
+		t.Errorf("expected the original image if all mirrors are unhealthy, got: %s", result)
+	}
+}
+
+func TestGetPullSecret(t *testing.T) {
+	Reset([]byte(`
+proxies:
+  docker.io:
+  - host: mirror.corp
+    pullSecret: corp-credentials
+  - host: mirror.corp/dockerhub
+    pullSecret: dockerhub-credentials
+  quay.io: quay.linkos.org
+`))
+	defer Reset(nil)
+
+	testdata := []struct {
+		image  string
+		result string
+	}{
+		{image: "mirror.corp/library/nginx:latest", result: "corp-credentials"},
+		{image: "mirror.corp/dockerhub/library/nginx:latest", result: "dockerhub-credentials"},
+		{image: "mirror.corporate/library/nginx:latest", result: ""},
+		{image: "quay.linkos.org/username/image:tag", result: ""},
+	}
+
+	for _, td := range testdata {
+		if result := GetPullSecret(td.image); result != td.result {
+			t.Errorf("get pull secret of %s failed, expected: %s, got: %s", td.image, td.result, result)
+		}
+	}
+
+	Reset(nil)
+	Reset([]byte(`
+proxies:
+  docker.io:
+    host: mirror.corp
+    pullSecret: Corp_Credentials
+`))
+	if GetPullSecret("mirror.corp/library/nginx:latest") != "" {
+		t.Errorf("mirror with invalid pull secret name should be rejected")
+	}
+
+	Reset([]byte(`
+proxies:
+  docker.io:
+    host: mirror.corp
+    pullSecret: mirrored-credentials
+`))
+	if GetPullSecret("mirror.corp/library/nginx:latest") != "" {
+		t.Errorf("mirror with pull secret name colliding with the mirrored pull secrets should be rejected")
+	}
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/ketches/registry-proxy/pkg/image"
+)
+
+// Profile is a named set of proxies and rules, the top level proxies and rules
+// of the config are the default profile.
+type Profile struct {
+	// Proxies is the map of registry domain and proxy mirrors
+	Proxies map[string]Mirrors `yaml:"proxies"`
+	// Rules is the ordered list of rewrite rules, the first matched rule wins.
+	// Rules take precedence over proxies.
+	Rules []Rule `yaml:"rules,omitempty"`
+	// Default is the text/template of the mirror host for registries not matched
+	// by rules and proxies, e.g. {{.RegistryDashed}}.mirror.corp. The template
+	// fields are Registry, e.g. us-docker.pkg.dev, and RegistryDashed, e.g. us-docker-pkg-dev.
+	Default string `yaml:"default,omitempty"`
+	// UnqualifiedRegistry is the registry which unqualified image names, e.g. nginx
+	// or myteam/app, resolve to instead of docker.io
+	UnqualifiedRegistry string `yaml:"unqualifiedRegistry,omitempty"`
+	// Workloads also rewrites the pod templates of workloads, e.g. Deployments and
+	// CronJobs, pods are always rewritten
+	Workloads bool `yaml:"workloads,omitempty"`
+
+	// wildcards is the wildcard keys of proxies, the most specific first
+	wildcards []string
+	// defaultTemplate is the compiled template of default
+	defaultTemplate *template.Template
+}
+
+// ParseImage parses the image, unqualified names are resolved to the unqualified
+// registry of the profile if configured. expanded reports whether the name is
+// resolved to the unqualified registry, in which case the image should be
+// rewritten to the fully qualified reference even if no mirror is configured.
+func (p *Profile) ParseImage(raw string) (ref *image.Reference, expanded bool, err error) {
+	if p.UnqualifiedRegistry == "" || image.Qualified(raw) {
+		ref, err = image.ParseReference(raw)
+		return ref, false, err
+	}
+	ref, err = image.ParseReference(p.UnqualifiedRegistry + "/" + raw)
+	return ref, p.UnqualifiedRegistry != "docker.io", err
+}
+
+// Rewrite rewrites the image reference with the profile, the precedence is:
+//
+// 1. Rules, in order, the first matched rule wins.
+//
+// 2. Proxies with the exact registry key, e.g. gcr.io.
+//
+// 3. Proxies with wildcard keys, e.g. *.gcr.io matches asia.gcr.io and eu.west.gcr.io
+// but not gcr.io. The longest matched key wins, keys of the same length are
+// compared lexically.
+//
+// 4. The default mirror, unless the registry is the hostname of a mirror, i.e. of
+// the configured mirrors of all profiles or of the rendered default mirrors.
+//
+// ok is false if the image should not be proxied.
+func (p *Profile) Rewrite(ref *image.Reference) (result string, ok bool) {
+	for i := range p.Rules {
+		if result, matched := p.Rules[i].Rewrite(ref); matched {
+			return result, result != ""
+		}
+	}
+
+	if mirrors, found := p.Proxies[ref.Registry]; found {
+		return mirrors.Rewrite(ref)
+	}
+	for _, key := range p.wildcards {
+		if strings.HasSuffix(ref.Registry, key[1:]) {
+			return p.Proxies[key].Rewrite(ref)
+		}
+	}
+	// the registry of an image already rewritten to a mirror is never a registry to proxy
+	if p.defaultTemplate != nil && !isMirrorHostname(ref.Registry) {
+		host, err := p.renderDefault(ref.Registry)
+		if err != nil {
+			log.Printf("Render default mirror of %s failed: %v", ref.Registry, err)
+			return "", false
+		}
+		mirror := Mirror{Host: host}
+		observeDefaultMirror(&mirror)
+		return Mirrors{mirror}.Rewrite(ref)
+	}
+	return "", false
+}
+
+// renderDefault renders the default mirror host of the registry
+func (p *Profile) renderDefault(registry string) (string, error) {
+	var buffer bytes.Buffer
+	err := p.defaultTemplate.Execute(&buffer, map[string]string{
+		"Registry":       registry,
+		"RegistryDashed": strings.NewReplacer(".", "-", ":", "-").Replace(registry),
+	})
+	return strings.TrimSpace(buffer.String()), err
+}
+
+// mirrors returns all mirror lists of the profile, rules first
+func (p *Profile) mirrors() []Mirrors {
+	var result []Mirrors
+	for _, rule := range p.Rules {
+		result = append(result, rule.Proxy)
+	}
+	for _, registry := range slices.Sorted(maps.Keys(p.Proxies)) {
+		result = append(result, p.Proxies[registry])
+	}
+	return result
+}
+
+// validate validates and compiles the profile
+func (p *Profile) validate() error {
+	p.wildcards = nil
+	for registry, mirrors := range p.Proxies {
+		if err := mirrors.validate(); err != nil {
+			return fmt.Errorf("proxies[%s]: %v", registry, err)
+		}
+		if strings.Contains(registry, "*") {
+			if !strings.HasPrefix(registry, "*.") || strings.Count(registry, "*") > 1 {
+				return fmt.Errorf("proxies[%s]: wildcard key must be in the form of *.<domain>", registry)
+			}
+			p.wildcards = append(p.wildcards, registry)
+		}
+	}
+	slices.SortFunc(p.wildcards, func(a, b string) int {
+		return cmp.Or(cmp.Compare(len(b), len(a)), strings.Compare(a, b))
+	})
+
+	p.defaultTemplate = nil
+	if p.Default != "" {
+		tmpl, err := template.New("default").Option("missingkey=error").Parse(p.Default)
+		if err != nil {
+			return fmt.Errorf("invalid default %q: %v", p.Default, err)
+		}
+		p.defaultTemplate = tmpl
+		host, err := p.renderDefault("sample.registry.io")
+		if err != nil {
+			return fmt.Errorf("invalid default %q: %v", p.Default, err)
+		}
+		if registry, _, err := image.Parse(host + "/sample"); err != nil || !strings.HasPrefix(host, registry) {
+			return fmt.Errorf("invalid default %q: rendered mirror %q is not a valid registry", p.Default, host)
+		}
+	}
+
+	if p.UnqualifiedRegistry != "" {
+		if err := validateRegistry(p.UnqualifiedRegistry); err != nil {
+			return fmt.Errorf("unqualifiedRegistry: %v", err)
+		}
+	}
+
+	for i := range p.Rules {
+		if err := p.Rules[i].validate(); err != nil {
+			return fmt.Errorf("rules[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// GetProfile get the profile with the name from the singleton config instance.
+// The default profile is returned if name is empty or the profile does not exist.
+func GetProfile(name string) *Profile {
+	if name == "" {
+		return &configInstance.Profile
+	}
+	if profile, ok := configInstance.Profiles[name]; ok {
+		return &profile
+	}
+	log.Printf("Profile %s not found, use the default profile", name)
+	return &configInstance.Profile
+}
+
+// WorkloadsEnabled reports whether any profile rewrites the pod templates of workloads
+func WorkloadsEnabled() bool {
+	if configInstance.Workloads {
+		return true
+	}
+	for _, profile := range configInstance.Profiles {
+		if profile.Workloads {
+			return true
+		}
+	}
+	return false
+}
+
+// Rewrite rewrites the image reference with the default profile.
+func Rewrite(ref *image.Reference) (result string, ok bool) {
+	return configInstance.Profile.Rewrite(ref)
+}
+
+// allProfiles returns the default profile and the named profiles
+func (c *config) allProfiles() []*Profile {
+	result := []*Profile{&c.Profile}
+	for _, name := range slices.Sorted(maps.Keys(c.Profiles)) {
+		profile := c.Profiles[name]
+		result = append(result, &profile)
+	}
+	return result
+}
+
+// allMirrors returns all mirror lists of the default profile and the named profiles
+func (c *config) allMirrors() []Mirrors {
+	var result []Mirrors
+	for _, profile := range c.allProfiles() {
+		result = append(result, profile.mirrors()...)
+	}
+	return result
+}
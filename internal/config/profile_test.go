@@ -0,0 +1,236 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/ketches/registry-proxy/internal/health"
+	"github.com/ketches/registry-proxy/pkg/image"
+)
+
+func TestGetProfile(t *testing.T) {
+	Reset([]byte(`
+proxies:
+  docker.io: docker.linkos.org
+profiles:
+  china:
+    proxies:
+      docker.io: docker.m.daocloud.io
+  eu:
+    rules:
+    - match: docker.io/**
+      proxy: mirror.eu.corp/dockerhub
+`))
+	defer Reset(nil)
+
+	testdata := []struct {
+		profile string
+		result  string
+	}{
+		{profile: "", result: "docker.linkos.org/library/nginx:latest"},
+		{profile: "china", result: "docker.m.daocloud.io/library/nginx:latest"},
+		{profile: "eu", result: "mirror.eu.corp/dockerhub/library/nginx:latest"},
+		{profile: "unknown", result: "docker.linkos.org/library/nginx:latest"},
+	}
+
+	ref, _ := image.ParseReference("nginx")
+	for _, td := range testdata {
+		if result, _ := GetProfile(td.profile).Rewrite(ref); result != td.result {
+			t.Errorf("rewrite with profile %q failed, expected: %s, got: %s", td.profile, td.result, result)
+		}
+	}
+}
+
+func TestResetRejectsInvalidProfiles(t *testing.T) {
+	Reset([]byte(`
+profiles:
+  eu:
+    rules:
+    - type: regex
+      match: ^docker\.io/(?P<repo>.+$
+      output: mirror.eu.corp/{{.repo}}
+`))
+	defer Reset(nil)
+
+	if _, ok := Get().Profiles["eu"]; ok {
+		t.Errorf("config with invalid profile should be rejected")
+	}
+}
+
+func TestProxiesPrecedence(t *testing.T) {
+	Reset([]byte(`
+proxies:
+  gcr.io: gcr.linkos.org
+  "*.gcr.io": regional-gcr.mirror.corp
+  "*.west.gcr.io": west-gcr.mirror.corp
+  "*.pkg.dev": pkg-dev.mirror.corp
+  docker.io: docker.linkos.org
+default: "{{.RegistryDashed}}.mirror.corp"
+rules:
+- match: asia.gcr.io/private/**
+  action: exclude
+- type: regex
+  match: ^ghcr\.io/(?P<repo>.+)$
+  output: ghcr.mirror.corp/{{.repo}}
+profiles:
+  eu:
+    proxies:
+      quay.io: quay.eu.corp/mirror
+`))
+	defer Reset(nil)
+
+	testdata := []struct {
+		image  string
+		result string
+	}{
+		// rules take precedence over proxies
+		{image: "asia.gcr.io/private/image:tag", result: "asia.gcr.io/private/image:tag"},
+		// exact keys take precedence over wildcard keys
+		{image: "gcr.io/project/image:tag", result: "gcr.linkos.org/project/image:tag"},
+		// wildcard keys match any depth of subdomains
+		{image: "asia.gcr.io/project/image:tag", result: "regional-gcr.mirror.corp/project/image:tag"},
+		{image: "us.east.gcr.io/project/image:tag", result: "regional-gcr.mirror.corp/project/image:tag"},
+		// the longest wildcard key wins
+		{image: "eu.west.gcr.io/project/image:tag", result: "west-gcr.mirror.corp/project/image:tag"},
+		{image: "us-docker.pkg.dev/project/repo/image:tag", result: "pkg-dev.mirror.corp/project/repo/image:tag"},
+		// the default mirror catches all other registries
+		{image: "myregistry.azurecr.io/image:tag", result: "myregistry-azurecr-io.mirror.corp/image:tag"},
+		{image: "localhost:5000/image:tag", result: "localhost-5000.mirror.corp/image:tag"},
+		// the default mirror skips the images already rewritten to mirrors, of the
+		// proxies and rules of all profiles, and of the default mirror itself
+		{image: "docker.linkos.org/library/nginx:1", result: "docker.linkos.org/library/nginx:1"},
+		{image: "ghcr.mirror.corp/org/app:v1", result: "ghcr.mirror.corp/org/app:v1"},
+		{image: "quay.eu.corp/mirror/org/app:v1", result: "quay.eu.corp/mirror/org/app:v1"},
+		{image: "myregistry-azurecr-io.mirror.corp/image:tag", result: "myregistry-azurecr-io.mirror.corp/image:tag"},
+	}
+
+	for _, td := range testdata {
+		ref, _ := image.ParseReference(td.image)
+		result, ok := Rewrite(ref)
+		if !ok {
+			result = td.image
+		}
+		if result != td.result {
+			t.Errorf("rewrite %s failed, expected: %s, got: %s", td.image, td.result, result)
+		}
+	}
+}
+
+func TestProfileValidate(t *testing.T) {
+	testdata := []struct {
+		profile Profile
+		valid   bool
+	}{
+		{
+			profile: Profile{Proxies: map[string]Mirrors{"*.gcr.io": {{Host: "gcr.linkos.org"}}}},
+			valid:   true,
+		}, {
+			profile: Profile{Proxies: map[string]Mirrors{"gcr.*": {{Host: "gcr.linkos.org"}}}},
+			valid:   false,
+		}, {
+			profile: Profile{Proxies: map[string]Mirrors{"*.*.gcr.io": {{Host: "gcr.linkos.org"}}}},
+			valid:   false,
+		}, {
+			profile: Profile{Default: "{{.RegistryDashed}}.mirror.corp"},
+			valid:   true,
+		}, {
+			profile: Profile{Default: "mirror.corp/{{.Registry}}"},
+			valid:   true,
+		}, {
+			profile: Profile{Default: "{{.Registry"},
+			valid:   false,
+		}, {
+			profile: Profile{Default: "{{.Host}}.mirror.corp"},
+			valid:   false,
+		}, {
+			profile: Profile{Default: "mirror"},
+			valid:   false,
+		}, {
+			profile: Profile{UnqualifiedRegistry: "harbor.corp"},
+			valid:   true,
+		}, {
+			profile: Profile{UnqualifiedRegistry: "harbor.corp/library"},
+			valid:   false,
+		},
+	}
+
+	for _, td := range testdata {
+		err := td.profile.validate()
+		if (err == nil) != td.valid {
+			t.Errorf("validate profile %+v failed, expected valid: %v, got error: %v", td.profile, td.valid, err)
+		}
+	}
+}
+
+func TestProfileParseImage(t *testing.T) {
+	profile := Profile{UnqualifiedRegistry: "harbor.corp"}
+
+	testdata := []struct {
+		image    string
+		result   string
+		expanded bool
+	}{
+		{image: "nginx", result: "harbor.corp/nginx:latest", expanded: true},
+		{image: "myteam/app:v1", result: "harbor.corp/myteam/app:v1", expanded: true},
+		{image: "docker.io/library/nginx", result: "docker.io/library/nginx:latest"},
+		{image: "localhost/app", result: "localhost/app:latest"},
+		{image: "localhost:5000/app", result: "localhost:5000/app:latest"},
+		{image: "registry.k8s.io/pause:3.9", result: "registry.k8s.io/pause:3.9"},
+	}
+
+	for _, td := range testdata {
+		ref, expanded, err := profile.ParseImage(td.image)
+		if err != nil {
+			t.Fatalf("parse image %s failed: %v", td.image, err)
+		}
+		if ref.String() != td.result || expanded != td.expanded {
+			t.Errorf("parse image %s failed, expected: %s %v, got: %s %v", td.image, td.result, td.expanded, ref.String(), expanded)
+		}
+	}
+
+	// without unqualified registry, short names resolve to docker.io
+	ref, expanded, _ := (&Profile{}).ParseImage("nginx")
+	if ref.String() != "docker.io/library/nginx:latest" || expanded {
+		t.Errorf("parse image nginx failed, got: %s %v", ref.String(), expanded)
+	}
+}
+
+func TestDefaultMirrorHealthCheck(t *testing.T) {
+	Reset([]byte(`
+default: "{{.RegistryDashed}}.mirror.corp"
+healthCheck:
+  enabled: true
+  interval: 1h
+`))
+	defer Reset(nil)
+	defer health.SetTargets(nil)
+
+	ref, _ := image.ParseReference("gcr.io/project/app:v1")
+	if result, _ := Rewrite(ref); result != "gcr-io.mirror.corp/project/app:v1" {
+		t.Fatalf("rewrite with the default mirror failed, got: %s", result)
+	}
+	if targets := GetHealthCheckTargets(); len(targets) != 1 || targets[0].Host != "gcr-io.mirror.corp" {
+		t.Errorf("rendered default mirror should be probed, got: %+v", targets)
+	}
+
+	health.MarkUnhealthy("gcr-io.mirror.corp")
+	defer health.MarkHealthy("gcr-io.mirror.corp")
+	if result, ok := Rewrite(ref); ok {
+		t.Errorf("unhealthy default mirror should be skipped, got: %s", result)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"path"
+	"slices"
+)
+
+// ImageReferences is the config of image references held out of container
+// images, which are rewritten with the same rules as container images.
+type ImageReferences struct {
+	// Env is the name patterns of container environment variables holding images,
+	// e.g. RELATED_IMAGE_* or *_IMAGE
+	Env []string `yaml:"env,omitempty"`
+	// Annotations is the key patterns of pod annotations holding images,
+	// e.g. sidecar.istio.io/proxyImage
+	Annotations []string `yaml:"annotations,omitempty"`
+}
+
+// validate validates the patterns of the imageReferences config
+func (r *ImageReferences) validate() error {
+	for _, pattern := range slices.Concat(r.Env, r.Annotations) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// MatchEnv reports whether the environment variable holds an image
+func (r *ImageReferences) MatchEnv(name string) bool {
+	return matchAny(r.Env, name)
+}
+
+// MatchAnnotation reports whether the annotation holds an image
+func (r *ImageReferences) MatchAnnotation(key string) bool {
+	return matchAny(r.Annotations, key)
+}
+
+// matchAny reports whether the name matches any of the patterns, "*" of the
+// patterns does not match "/"
+func matchAny(patterns []string, name string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		matched, _ := path.Match(pattern, name)
+		return matched
+	})
+}
+
+// GetImageReferences get the singleton config instance's imageReferences
+func GetImageReferences() ImageReferences {
+	return configInstance.ImageReferences
+}
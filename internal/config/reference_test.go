@@ -0,0 +1,53 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import "testing"
+
+func TestImageReferencesMatch(t *testing.T) {
+	refs := ImageReferences{
+		Env:         []string{"RELATED_IMAGE_*", "*_IMAGE"},
+		Annotations: []string{"sidecar.istio.io/proxyImage", "*.vault.io/*-image"},
+	}
+	if err := refs.validate(); err != nil {
+		t.Fatalf("validate imageReferences failed: %v", err)
+	}
+
+	for name, matched := range map[string]bool{
+		"RELATED_IMAGE_OPERAND": true,
+		"AGENT_IMAGE":           true,
+		"IMAGE_PULL_POLICY":     false,
+	} {
+		if got := refs.MatchEnv(name); got != matched {
+			t.Errorf("match env %s failed, expected: %v, got: %v", name, matched, got)
+		}
+	}
+	for key, matched := range map[string]bool{
+		"sidecar.istio.io/proxyImage":     true,
+		"agent.vault.io/agent-image":      true,
+		"sidecar.istio.io/proxyCPU":       false,
+		"team.example.com/agent.vault.io": false,
+	} {
+		if got := refs.MatchAnnotation(key); got != matched {
+			t.Errorf("match annotation %s failed, expected: %v, got: %v", key, matched, got)
+		}
+	}
+
+	if err := (&ImageReferences{Env: []string{"RELATED_IMAGE_["}}).validate(); err == nil {
+		t.Errorf("validate invalid pattern should fail")
+	}
+}
@@ -0,0 +1,232 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ketches/registry-proxy/internal/global"
+	"github.com/ketches/registry-proxy/pkg/util"
+)
+
+// PinDigestResolveFrom is where to resolve the digest of a tag
+type PinDigestResolveFrom string
+
+const (
+	// PinDigestResolveFromMirror resolves the digest from the rewritten image's registry
+	PinDigestResolveFromMirror PinDigestResolveFrom = "mirror"
+	// PinDigestResolveFromUpstream resolves the digest from the original image's registry
+	PinDigestResolveFromUpstream PinDigestResolveFrom = "upstream"
+)
+
+// PinDigest is the config of pinning rewritten image tags to manifest digests
+type PinDigest struct {
+	// Enabled is the flag to pin the rewritten image tag to the manifest digest
+	Enabled bool `yaml:"enabled"`
+	// ResolveFrom is where to resolve the digest, mirror (default) or upstream
+	ResolveFrom PinDigestResolveFrom `yaml:"resolveFrom,omitempty"`
+	// Timeout is the deadline of resolving digests in an admission request, default is 2s
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// CacheTTL is the time to live of resolved digests, default is 10m
+	CacheTTL time.Duration `yaml:"cacheTTL,omitempty"`
+}
+
+const (
+	defaultPinDigestTimeout  = 2 * time.Second
+	defaultPinDigestCacheTTL = 10 * time.Minute
+)
+
+// validate validates the pinDigest config
+func (pin *PinDigest) validate() error {
+	switch pin.ResolveFrom {
+	case "", PinDigestResolveFromMirror, PinDigestResolveFromUpstream:
+	default:
+		return fmt.Errorf("unknown resolveFrom %q", pin.ResolveFrom)
+	}
+	return validateResolveTimeout(pin.Timeout)
+}
+
+// Verify is the config of verifying rewritten images exist on mirrors
+type Verify struct {
+	// Enabled is the flag to rewrite an image only if its manifest exists on the mirror
+	Enabled bool `yaml:"enabled"`
+	// MatchDigest also requires the manifest digest on the mirror to match the upstream one
+	MatchDigest bool `yaml:"matchDigest,omitempty"`
+	// Timeout is the deadline of verifying images in an admission request, default is 2s
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// CacheTTL is the time to live of verification results, default is 10m
+	CacheTTL time.Duration `yaml:"cacheTTL,omitempty"`
+}
+
+const (
+	defaultVerifyTimeout  = 2 * time.Second
+	defaultVerifyCacheTTL = 10 * time.Minute
+)
+
+// validate validates the verify config
+func (v *Verify) validate() error {
+	return validateResolveTimeout(v.Timeout)
+}
+
+// validateResolveTimeout validates that the timeout leaves time for the webhook to respond
+func validateResolveTimeout(timeout time.Duration) error {
+	if timeout >= global.WebhookTimeoutSeconds*time.Second {
+		return fmt.Errorf("timeout %s must be less than the webhook timeout %ds", timeout, global.WebhookTimeoutSeconds)
+	}
+	return nil
+}
+
+// PrivateImages is the config of skipping private images, which would never
+// resolve on public mirrors
+type PrivateImages struct {
+	// Enabled skips rewriting images whose original registry has credentials in the
+	// image pull secrets of the pod or its service account
+	Enabled bool `yaml:"enabled"`
+	// Probe also skips images which can not be pulled anonymously from the original registry
+	Probe bool `yaml:"probe,omitempty"`
+	// Timeout is the deadline of probing images in an admission request, default is 2s
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// CacheTTL is the time to live of probe results, default is 1h
+	CacheTTL time.Duration `yaml:"cacheTTL,omitempty"`
+}
+
+const (
+	defaultPrivateImagesTimeout  = 2 * time.Second
+	defaultPrivateImagesCacheTTL = time.Hour
+)
+
+// validate validates the private images config
+func (p *PrivateImages) validate() error {
+	return validateResolveTimeout(p.Timeout)
+}
+
+// GetPinDigest get the singleton config instance's pinDigest with defaults applied
+func GetPinDigest() PinDigest {
+	pin := configInstance.PinDigest
+	pin.ResolveFrom = util.ValueIf(pin.ResolveFrom != "", pin.ResolveFrom, PinDigestResolveFromMirror)
+	pin.Timeout = util.ValueIf(pin.Timeout > 0, pin.Timeout, defaultPinDigestTimeout)
+	pin.CacheTTL = util.ValueIf(pin.CacheTTL > 0, pin.CacheTTL, defaultPinDigestCacheTTL)
+	return pin
+}
+
+// GetVerify get the singleton config instance's verify with defaults applied
+func GetVerify() Verify {
+	v := configInstance.Verify
+	v.Timeout = util.ValueIf(v.Timeout > 0, v.Timeout, defaultVerifyTimeout)
+	v.CacheTTL = util.ValueIf(v.CacheTTL > 0, v.CacheTTL, defaultVerifyCacheTTL)
+	return v
+}
+
+// GetPrivateImages get the singleton config instance's privateImages with defaults applied
+func GetPrivateImages() PrivateImages {
+	p := configInstance.PrivateImages
+	p.Timeout = util.ValueIf(p.Timeout > 0, p.Timeout, defaultPrivateImagesTimeout)
+	p.CacheTTL = util.ValueIf(p.CacheTTL > 0, p.CacheTTL, defaultPrivateImagesCacheTTL)
+	return p
+}
+
+// GetResolveTimeout gets the deadline of resolving images from registries in an
+// admission request, which is the longest timeout of the enabled features.
+func GetResolveTimeout() time.Duration {
+	var timeout time.Duration
+	if pin := GetPinDigest(); pin.Enabled {
+		timeout = max(timeout, pin.Timeout)
+	}
+	if v := GetVerify(); v.Enabled {
+		timeout = max(timeout, v.Timeout)
+	}
+	if p := GetPrivateImages(); p.Enabled && p.Probe {
+		timeout = max(timeout, p.Timeout)
+	}
+	return util.ValueIf(timeout > 0, timeout, defaultPinDigestTimeout)
+}
+
+// GetMirrorTLS gets the TLS settings of the first configured mirror with the hostname.
+func GetMirrorTLS(hostname string) (caBundle string, insecureSkipVerify bool) {
+	for _, mirrors := range configInstance.allMirrors() {
+		for i := range mirrors {
+			if mirrors[i].Hostname() == hostname {
+				return mirrors[i].CABundle, mirrors[i].InsecureSkipVerify
+			}
+		}
+	}
+	return "", false
+}
+
+// GetPullSecret gets the source pull secret of the mirror which the rewritten
+// image belongs to. It is empty if the mirror has no pull secret.
+func GetPullSecret(rewritten string) string {
+	if m := findMirror(rewritten, func(m *Mirror) bool { return m.PullSecret != "" }); m != nil {
+		return m.PullSecret
+	}
+	return ""
+}
+
+// IsPullSecret reports whether the name is the source pull secret of any mirror
+// in the singleton config instance, including the mirrors of all profiles.
+func IsPullSecret(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, mirrors := range configInstance.allMirrors() {
+		for i := range mirrors {
+			if mirrors[i].PullSecret == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PullSecretsEnabled reports whether any mirror in the singleton config instance
+// has a pull secret or passes the credentials through.
+func PullSecretsEnabled() bool {
+	for _, mirrors := range configInstance.allMirrors() {
+		for i := range mirrors {
+			if mirrors[i].PullSecret != "" || mirrors[i].PassCredentials {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetCredentialMirror gets the host of the mirror which the rewritten image
+// belongs to if the mirror passes the credentials through, otherwise empty.
+func GetCredentialMirror(rewritten string) string {
+	if m := findMirror(rewritten, func(m *Mirror) bool { return m.PassCredentials }); m != nil {
+		return m.Host
+	}
+	return ""
+}
+
+// findMirror finds the mirror matching fn which the rewritten image belongs to,
+// the mirror with the longest matched host wins.
+func findMirror(rewritten string, fn func(m *Mirror) bool) *Mirror {
+	var result *Mirror
+	for _, mirrors := range configInstance.allMirrors() {
+		for i := range mirrors {
+			m := &mirrors[i]
+			if fn(m) && (result == nil || len(m.Host) > len(result.Host)) && strings.HasPrefix(rewritten, m.Host+"/") {
+				result = m
+			}
+		}
+	}
+	return result
+}
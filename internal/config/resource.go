@@ -0,0 +1,83 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+
+	"github.com/ketches/registry-proxy/pkg/fieldpath"
+)
+
+// Resource is a resource out of pods holding images, e.g. TaskRuns of Tekton,
+// the images of the resource are rewritten with the same rules as pods.
+type Resource struct {
+	// Group is the API group of the resource, e.g. tekton.dev
+	Group string `yaml:"group"`
+	// Version is the API version of the resource, e.g. v1
+	Version string `yaml:"version"`
+	// Resource is the plural resource name, e.g. taskruns
+	Resource string `yaml:"resource"`
+	// Paths is the JSONPath-style field paths of images, e.g. .spec.taskSpec.steps[*].image
+	Paths []string `yaml:"paths"`
+
+	// paths is the parsed paths
+	paths []fieldpath.Path
+}
+
+// validate validates the resource and parses the paths
+func (r *Resource) validate() error {
+	if r.Version == "" || r.Resource == "" {
+		return fmt.Errorf("version and resource are required")
+	}
+	if r.Group == "" && r.Resource == "pods" {
+		return fmt.Errorf("pods are always proxied")
+	}
+	if len(r.Paths) == 0 {
+		return fmt.Errorf("paths are required")
+	}
+
+	r.paths = nil
+	for _, raw := range r.Paths {
+		p, err := fieldpath.Parse(raw)
+		if err != nil {
+			return err
+		}
+		r.paths = append(r.paths, p)
+	}
+	return nil
+}
+
+// FieldPaths returns the parsed field paths of images
+func (r *Resource) FieldPaths() []fieldpath.Path {
+	return r.paths
+}
+
+// GetResources get the singleton config instance's resources
+func GetResources() []Resource {
+	return configInstance.Resources
+}
+
+// GetResource returns the resource of the group, version and resource, nil if
+// not configured.
+func GetResource(group, version, resource string) *Resource {
+	for i, r := range configInstance.Resources {
+		if r.Group == group && r.Version == version && r.Resource == resource {
+			return &configInstance.Resources[i]
+		}
+	}
+	return nil
+}
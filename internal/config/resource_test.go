@@ -0,0 +1,53 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import "testing"
+
+func TestResourceValidate(t *testing.T) {
+	testdata := []struct {
+		resource Resource
+		valid    bool
+	}{
+		{
+			resource: Resource{Group: "tekton.dev", Version: "v1", Resource: "taskruns", Paths: []string{".spec.taskSpec.steps[*].image"}},
+			valid:    true,
+		}, {
+			resource: Resource{Group: "kubevirt.io", Version: "v1", Resource: "virtualmachines", Paths: []string{".spec.template.spec.volumes[*].containerDisk.image"}},
+			valid:    true,
+		}, {
+			resource: Resource{Group: "tekton.dev", Version: "v1", Resource: "taskruns"},
+			valid:    false,
+		}, {
+			resource: Resource{Group: "tekton.dev", Resource: "taskruns", Paths: []string{".spec.taskSpec.steps[*].image"}},
+			valid:    false,
+		}, {
+			resource: Resource{Version: "v1", Resource: "pods", Paths: []string{".spec.containers[*].image"}},
+			valid:    false,
+		}, {
+			resource: Resource{Group: "tekton.dev", Version: "v1", Resource: "taskruns", Paths: []string{".spec.taskSpec.steps[0].image"}},
+			valid:    false,
+		},
+	}
+
+	for _, td := range testdata {
+		err := td.resource.validate()
+		if (err == nil) != td.valid {
+			t.Errorf("validate resource %+v failed, expected valid: %v, got error: %v", td.resource, td.valid, err)
+		}
+	}
+}
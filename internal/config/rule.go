@@ -0,0 +1,239 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/ketches/registry-proxy/pkg/image"
+)
+
+// RuleType is the match type of a rewrite rule
+type RuleType string
+
+const (
+	// RuleTypeGlob matches the registry and repository by glob pattern
+	RuleTypeGlob RuleType = "glob"
+	// RuleTypeRegex matches the full image by regular expression
+	RuleTypeRegex RuleType = "regex"
+)
+
+// RuleAction is the action of a rewrite rule
+type RuleAction string
+
+const (
+	// RuleActionProxy rewrites the matched image to the proxy
+	RuleActionProxy RuleAction = "proxy"
+	// RuleActionExclude leaves the matched image untouched
+	RuleActionExclude RuleAction = "exclude"
+)
+
+// Rule is a rewrite rule matched on the registry and repository of an image
+type Rule struct {
+	// Type is the match type of the rule, default is glob
+	Type RuleType `yaml:"type,omitempty"`
+	// Match is the pattern of the image.
+	// For glob rules, it is matched on the registry and repository, e.g. docker.io/bitnami/*,
+	// `*` matches within a single path segment, `**` matches any number of segments.
+	// For regex rules, it is matched on the full image with tag or digest,
+	// e.g. ^quay\.io/(?P<org>[^/]+)/(?P<repo>.+)$.
+	Match string `yaml:"match"`
+	// Action is the action of the matched image, default is proxy
+	Action RuleAction `yaml:"action,omitempty"`
+	// Proxy is the mirrors the matched image is rewritten to, only for glob rules
+	Proxy Mirrors `yaml:"proxy,omitempty"`
+	// Output is the text/template of the rewritten image, only for regex rules.
+	// Named capture groups of match are the template fields, e.g. mirror.corp/quay-{{.org}}/{{.repo}}
+	Output string `yaml:"output,omitempty"`
+
+	regexp   *regexp.Regexp
+	template *template.Template
+}
+
+// validate validates and compiles the rule
+func (r *Rule) validate() error {
+	if r.Match == "" {
+		return fmt.Errorf("match is required")
+	}
+
+	switch r.Type {
+	case "", RuleTypeGlob:
+		for _, segment := range strings.Split(r.Match, "/") {
+			if segment == "" {
+				return fmt.Errorf("invalid match %q: empty path segment", r.Match)
+			}
+			if _, err := path.Match(segment, ""); err != nil {
+				return fmt.Errorf("invalid match %q: %v", r.Match, err)
+			}
+		}
+		if r.Output != "" {
+			return fmt.Errorf("output is only supported by regex rule %q", r.Match)
+		}
+	case RuleTypeRegex:
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return fmt.Errorf("invalid match %q: %v", r.Match, err)
+		}
+		r.regexp = re
+		if len(r.Proxy) > 0 {
+			return fmt.Errorf("proxy is not supported by regex rule %q, use output instead", r.Match)
+		}
+	default:
+		return fmt.Errorf("unknown type %q for rule %q", r.Type, r.Match)
+	}
+
+	switch r.Action {
+	case "", RuleActionProxy:
+		if r.regexp != nil {
+			return r.compileOutput()
+		}
+		if len(r.Proxy) == 0 {
+			return fmt.Errorf("proxy is required for rule %q", r.Match)
+		}
+		if err := r.Proxy.validate(); err != nil {
+			return fmt.Errorf("invalid proxy of rule %q: %v", r.Match, err)
+		}
+	case RuleActionExclude:
+	default:
+		return fmt.Errorf("unknown action %q for rule %q", r.Action, r.Match)
+	}
+	return nil
+}
+
+// compileOutput compiles the output template, and verifies that it renders a valid
+// image with sample values of the named capture groups.
+func (r *Rule) compileOutput() error {
+	if r.Output == "" {
+		return fmt.Errorf("output is required for rule %q", r.Match)
+	}
+	tmpl, err := template.New(r.Match).Option("missingkey=error").Parse(r.Output)
+	if err != nil {
+		return fmt.Errorf("invalid output %q: %v", r.Output, err)
+	}
+	r.template = tmpl
+
+	sample := make(map[string]string)
+	for _, name := range r.regexp.SubexpNames() {
+		if name != "" {
+			sample[name] = "sample"
+		}
+	}
+	out, err := r.execute(sample)
+	if err != nil {
+		return fmt.Errorf("invalid output %q: %v", r.Output, err)
+	}
+	if _, _, err := image.Parse(out); err != nil {
+		return fmt.Errorf("invalid output %q: rendered image %q is not a valid reference", r.Output, out)
+	}
+	return nil
+}
+
+// execute renders the output template
+func (r *Rule) execute(data map[string]string) (string, error) {
+	var buffer bytes.Buffer
+	if err := r.template.Execute(&buffer, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buffer.String()), nil
+}
+
+// outputHostname returns the hostname of the output of a regex rule, empty if
+// the hostname is not literal, e.g. {{.registry}}.mirror.corp.
+func (r *Rule) outputHostname() string {
+	hostname, _, _ := strings.Cut(r.Output, "/")
+	if strings.Contains(hostname, "{{") {
+		return ""
+	}
+	return hostname
+}
+
+// Matches reports whether the rule matches the image reference.
+func (r *Rule) Matches(ref *image.Reference) bool {
+	if r.regexp != nil {
+		return r.regexp.MatchString(ref.String())
+	}
+	return matchGlob(strings.Split(r.Match, "/"), strings.Split(ref.Registry+"/"+ref.Repository, "/"))
+}
+
+// Excluded reports whether the matched image should be left untouched.
+func (r *Rule) Excluded() bool {
+	return r.Action == RuleActionExclude
+}
+
+// Rewrite rewrites the image reference if the rule matches.
+// matched reports whether the rule matches, result is empty if the image should be left untouched.
+func (r *Rule) Rewrite(ref *image.Reference) (result string, matched bool) {
+	if !r.Matches(ref) {
+		return "", false
+	}
+	if r.Excluded() {
+		return "", true
+	}
+	if r.regexp == nil {
+		result, _ = r.Proxy.Rewrite(ref)
+		return result, true
+	}
+
+	var (
+		data    = make(map[string]string)
+		matches = r.regexp.FindStringSubmatch(ref.String())
+	)
+	for i, name := range r.regexp.SubexpNames() {
+		if name != "" {
+			data[name] = matches[i]
+		}
+	}
+	result, err := r.execute(data)
+	if err != nil {
+		log.Printf("Render output of rule %q failed: %v", r.Match, err)
+		return "", true
+	}
+	if _, _, err := image.Parse(result); err != nil {
+		log.Printf("Rule %q rendered invalid image %q", r.Match, result)
+		return "", true
+	}
+	return result, true
+}
+
+// matchGlob reports whether the path segments match the pattern segments.
+// `**` matches zero or more segments, other segments are matched by path.Match.
+func matchGlob(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchGlob(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/ketches/registry-proxy/pkg/image"
+)
+
+func TestRuleMatches(t *testing.T) {
+	testdata := []struct {
+		match      string
+		registry   string
+		repository string
+		matched    bool
+	}{
+		{
+			match:      "docker.io/bitnami/*",
+			registry:   "docker.io",
+			repository: "bitnami/nginx",
+			matched:    true,
+		}, {
+			match:      "docker.io/bitnami/*",
+			registry:   "docker.io",
+			repository: "bitnami/charts/nginx",
+			matched:    false,
+		}, {
+			match:      "docker.io/bitnami/*",
+			registry:   "docker.io",
+			repository: "library/nginx",
+			matched:    false,
+		}, {
+			match:      "ghcr.io/our-org/**",
+			registry:   "ghcr.io",
+			repository: "our-org/team/app",
+			matched:    true,
+		}, {
+			match:      "ghcr.io/our-org/**",
+			registry:   "ghcr.io",
+			repository: "other-org/app",
+			matched:    false,
+		}, {
+			match:      "ghcr.io/**/app",
+			registry:   "ghcr.io",
+			repository: "our-org/team/app",
+			matched:    true,
+		}, {
+			match:      "*.gcr.io/**",
+			registry:   "asia.gcr.io",
+			repository: "project/image",
+			matched:    true,
+		}, {
+			match:      "docker.io/library/redis-*",
+			registry:   "docker.io",
+			repository: "library/redis-stack",
+			matched:    true,
+		},
+	}
+
+	for _, td := range testdata {
+		rule := Rule{Match: td.match}
+		if got := rule.Matches(&image.Reference{Registry: td.registry, Repository: td.repository}); got != td.matched {
+			t.Errorf("match %s against %s/%s failed, expected: %v, got: %v", td.match, td.registry, td.repository, td.matched, got)
+		}
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	testdata := []struct {
+		rule  Rule
+		valid bool
+	}{
+		{
+			rule:  Rule{Match: "docker.io/**", Proxy: Mirrors{{Host: "docker.linkos.org"}}},
+			valid: true,
+		}, {
+			rule:  Rule{Match: "ghcr.io/our-org/**", Action: RuleActionExclude},
+			valid: true,
+		}, {
+			rule:  Rule{Match: "docker.io/**"},
+			valid: false,
+		}, {
+			rule:  Rule{Match: "docker.io/[a-", Proxy: Mirrors{{Host: "docker.linkos.org"}}},
+			valid: false,
+		}, {
+			rule:  Rule{Match: "docker.io//nginx", Proxy: Mirrors{{Host: "docker.linkos.org"}}},
+			valid: false,
+		}, {
+			rule:  Rule{Match: "docker.io/**", Action: "drop"},
+			valid: false,
+		}, {
+			rule:  Rule{Type: RuleTypeRegex, Match: `^quay\.io/(?P<org>[^/]+)/(?P<repo>.+)$`, Output: "mirror.corp/quay-{{.org}}/{{.repo}}"},
+			valid: true,
+		}, {
+			rule:  Rule{Type: RuleTypeRegex, Match: `^quay\.io/(?P<org>[^/]+`, Output: "mirror.corp/{{.org}}"},
+			valid: false,
+		}, {
+			rule:  Rule{Type: RuleTypeRegex, Match: `^quay\.io/(?P<org>[^/]+)/(?P<repo>.+)$`},
+			valid: false,
+		}, {
+			rule:  Rule{Type: RuleTypeRegex, Match: `^quay\.io/(?P<org>[^/]+)/(?P<repo>.+)$`, Output: "mirror.corp/{{.org"},
+			valid: false,
+		}, {
+			rule:  Rule{Type: RuleTypeRegex, Match: `^quay\.io/(?P<org>[^/]+)/(?P<repo>.+)$`, Output: "mirror.corp/{{.project}}/{{.repo}}"},
+			valid: false,
+		}, {
+			rule:  Rule{Type: RuleTypeRegex, Match: `^quay\.io/(?P<org>[^/]+)/(?P<repo>.+)$`, Output: "Mirror.Corp:{{.org}}/{{.repo}}"},
+			valid: false,
+		}, {
+			rule:  Rule{Type: RuleTypeRegex, Match: `^ghcr\.io/our-org/`, Action: RuleActionExclude},
+			valid: true,
+		},
+	}
+
+	for _, td := range testdata {
+		err := td.rule.validate()
+		if (err == nil) != td.valid {
+			t.Errorf("validate rule %+v failed, expected valid: %v, got error: %v", td.rule, td.valid, err)
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	Reset([]byte(`
+proxies:
+  docker.io: docker.linkos.org
+  ghcr.io: ghcr.linkos.org
+rules:
+- match: docker.io/bitnami/*
+  proxy: harbor.corp/bitnami
+- match: ghcr.io/our-org/**
+  action: exclude
+- type: regex
+  match: ^quay\.io/(?P<org>[^/]+)/(?P<repo>.+)$
+  output: mirror.corp/quay-{{.org}}/{{.repo}}
+- match: docker.io/**
+  proxy: harbor.corp/dockerhub
+`))
+	defer Reset(nil)
+
+	testdata := []struct {
+		image  string
+		result string
+		ok     bool
+	}{
+		{
+			image:  "bitnami/nginx:1.25",
+			result: "harbor.corp/bitnami/bitnami/nginx:1.25",
+			ok:     true,
+		}, {
+			image:  "nginx",
+			result: "harbor.corp/dockerhub/library/nginx:latest",
+			ok:     true,
+		}, {
+			image: "ghcr.io/our-org/app:v1",
+			ok:    false,
+		}, {
+			image:  "ghcr.io/other-org/app:v1",
+			result: "ghcr.linkos.org/other-org/app:v1",
+			ok:     true,
+		}, {
+			image:  "quay.io/prometheus/prometheus:v2.53.0",
+			result: "mirror.corp/quay-prometheus/prometheus:v2.53.0",
+			ok:     true,
+		}, {
+			image: "registry.k8s.io/pause:3.9",
+			ok:    false,
+		},
+	}
+
+	for _, td := range testdata {
+		ref, err := image.ParseReference(td.image)
+		if err != nil {
+			t.Fatalf("parse image %s failed: %v", td.image, err)
+		}
+		result, ok := Rewrite(ref)
+		if result != td.result || ok != td.ok {
+			t.Errorf("rewrite %s failed, expected: %s %v, got: %s %v", td.image, td.result, td.ok, result, ok)
+		}
+	}
+}
+
+func TestResetRejectsInvalidRules(t *testing.T) {
+	Reset([]byte(`
+proxies:
+  docker.io: docker.linkos.org
+`))
+	defer Reset(nil)
+
+	Reset([]byte(`
+rules:
+- match: docker.io/**
+`))
+	ref, _ := image.ParseReference("nginx")
+	if result, _ := Rewrite(ref); result != "docker.linkos.org/library/nginx:latest" {
+		t.Errorf("invalid config should be rejected, got: %s", result)
+	}
+}
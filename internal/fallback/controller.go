@@ -0,0 +1,317 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fallback
+
+import (
+	"context"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ketches/registry-proxy/internal/annotation"
+	"github.com/ketches/registry-proxy/internal/config"
+	"github.com/ketches/registry-proxy/internal/global"
+	"github.com/ketches/registry-proxy/internal/health"
+	"github.com/ketches/registry-proxy/pkg/cache"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// checkInterval is the interval of checking the stuck containers
+	checkInterval = 15 * time.Second
+	// cacheSize is the max number of handled pods and workloads kept
+	cacheSize = 4096
+)
+
+// Event reasons of the fallback decisions
+const (
+	ReasonMirrorPullFailed           = "MirrorPullFailed"
+	ReasonFallbackPodDeleted         = "FallbackPodDeleted"
+	ReasonFallbackRetryLimitExceeded = "FallbackRetryLimitExceeded"
+	ReasonFallbackUncontrolled       = "FallbackUncontrolled"
+	ReasonFallbackWorkloadTemplate   = "FallbackWorkloadTemplate"
+	ReasonFallbackTemplateRestored   = "FallbackTemplateRestored"
+)
+
+// pullErrors is the waiting reasons of containers failing to pull images
+var pullErrors = []string{"ErrImagePull", "ImagePullBackOff"}
+
+// Controller falls back from the mirrors which the rewritten images of pods are
+// stuck pulling from. The failed images are marked so that the mirrors are skipped
+// for them, and the pods controlled by workloads are deleted to be recreated with
+// the next mirror or the original registry.
+type Controller struct {
+	client   kubernetes.Interface
+	factory  informers.SharedInformerFactory
+	pods     listerscorev1.PodLister
+	recorder record.EventRecorder
+
+	// stuckSince is the time the containers are first seen stuck, keyed by pod uid and container name
+	stuckSince map[string]time.Time
+	// handled is the pods already fallen back
+	handled *cache.Cache[types.UID, struct{}]
+	// retries is the number of pods deleted per workload
+	retries *cache.Cache[string, int]
+	// now returns the current time
+	now func() time.Time
+
+	// trigger coalesces the reconciliation requests
+	trigger chan struct{}
+}
+
+// NewController returns a fallback controller watching the rewritten pods
+func NewController(client kubernetes.Interface) *Controller {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+
+	c := &Controller{
+		client:     client,
+		recorder:   broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: global.TargetName}),
+		stuckSince: make(map[string]time.Time),
+		handled:    cache.New[types.UID, struct{}](cacheSize),
+		retries:    cache.New[string, int](cacheSize),
+		now:        time.Now,
+		trigger:    make(chan struct{}, 1),
+	}
+	c.factory = informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.LabelSelector = global.PodLabelProxied + "=true"
+	}))
+	c.factory.Core().V1().Pods().Informer().AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(any, any) { c.Trigger() },
+	})
+	c.pods = c.factory.Core().V1().Pods().Lister()
+	return c
+}
+
+// Trigger requests a reconciliation, requests are coalesced while one is pending.
+func (c *Controller) Trigger() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Start starts the informer and waits for the cache to be synced.
+func (c *Controller) Start(stop <-chan struct{}) bool {
+	c.factory.Start(stop)
+	for _, synced := range c.factory.WaitForCacheSync(stop) {
+		if !synced {
+			return false
+		}
+	}
+	return true
+}
+
+// Run starts the controller and reconciles periodically until stop is closed.
+func (c *Controller) Run(stop <-chan struct{}) {
+	if !c.Start(stop) {
+		log.Println("Fallback controller failed to sync caches.")
+		return
+	}
+	log.Println("Fallback controller started")
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-c.trigger:
+		case <-ticker.C:
+		}
+		c.Reconcile(context.Background())
+	}
+}
+
+// Reconcile falls back the pods whose rewritten images are stuck longer than
+// the configured duration.
+func (c *Controller) Reconcile(ctx context.Context) {
+	f := config.GetFallback()
+	if !f.Enabled {
+		clear(c.stuckSince)
+		return
+	}
+
+	pods, err := c.pods.List(labels.Everything())
+	if err != nil {
+		log.Printf("List rewritten pods failed: %v", err)
+		return
+	}
+
+	now := c.now()
+	seen := make(map[string]bool)
+	for _, pod := range pods {
+		if _, ok := c.handled.Get(pod.UID); ok || pod.DeletionTimestamp != nil {
+			continue
+		}
+
+		record := annotation.OriginalImages(pod)
+		var stuck []corev1.ContainerStatus
+		for _, status := range slices.Concat(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses) {
+			if status.State.Waiting == nil || !slices.Contains(pullErrors, status.State.Waiting.Reason) {
+				continue
+			}
+			if original, ok := record[status.Name]; !ok || original == status.Image {
+				continue
+			}
+			key := string(pod.UID) + "/" + status.Name
+			seen[key] = true
+			if _, ok := c.stuckSince[key]; !ok {
+				c.stuckSince[key] = now
+			}
+			if now.Sub(c.stuckSince[key]) >= f.After {
+				stuck = append(stuck, status)
+			}
+		}
+		if len(stuck) > 0 {
+			c.fallback(ctx, f, pod, record, stuck)
+		}
+	}
+
+	for key := range c.stuckSince {
+		if !seen[key] {
+			delete(c.stuckSince, key)
+		}
+	}
+}
+
+// fallback marks the stuck images failed, and deletes the pod if it is controlled
+// by a workload which has not exceeded the retry limit. If the pod template of
+// the workload holds the failed images and their recorded originals, i.e. it is
+// rewritten by the workloads of the profile, the recreated pod would not be
+// rewritten again, so the images of the template are restored to the originals
+// instead, and the webhook rewrites them without the failed mirrors.
+func (c *Controller) fallback(ctx context.Context, f config.Fallback, pod *corev1.Pod, record map[string]string, stuck []corev1.ContainerStatus) {
+	for _, status := range stuck {
+		image := failedImage(status.Image, record[status.Name])
+		health.MarkImageFailed(image, f.FailureTTL)
+		imagePullFailures.WithLabelValues(mirrorHost(image)).Inc()
+		c.recorder.Eventf(pod, corev1.EventTypeWarning, ReasonMirrorPullFailed,
+			"Image %s of container %s failed to be pulled for %s, skip the mirror for %s", status.Image, status.Name, f.After, f.FailureTTL)
+	}
+
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		c.decide(pod, f, decisionUncontrolled)
+		c.recorder.Event(pod, corev1.EventTypeWarning, ReasonFallbackUncontrolled,
+			"Pod is not controlled by a workload, recreate it to fall back from the failed mirror")
+		return
+	}
+
+	template, err := c.workloadTemplate(ctx, pod.Namespace, owner)
+	if err != nil {
+		log.Printf("Get workload %s %s of pod %s/%s failed: %v", owner.Kind, owner.Name, pod.Namespace, pod.Name, err)
+		return
+	}
+	var restore []byte
+	if template != nil {
+		if restore, err = template.restorePatch(pod, stuck); err != nil {
+			log.Printf("Marshal patch of %s %s failed: %v", template.kind, template.name, err)
+			return
+		}
+	}
+	if restore != nil && template.patch == nil {
+		c.decide(pod, f, decisionWorkloadTemplate)
+		c.recorder.Eventf(pod, corev1.EventTypeWarning, ReasonFallbackWorkloadTemplate,
+			"Immutable pod template of %s %s is rewritten to the failed mirror, pod is kept", template.kind, template.name)
+		return
+	}
+
+	kind, name := owner.Kind, owner.Name
+	if restore != nil {
+		kind, name = template.kind, template.name
+	}
+	workload := pod.Namespace + "/" + kind + "/" + name
+	retries, _ := c.retries.Get(workload)
+	if retries >= f.MaxRetries {
+		c.decide(pod, f, decisionRetryLimitExceeded)
+		c.recorder.Eventf(pod, corev1.EventTypeWarning, ReasonFallbackRetryLimitExceeded,
+			"%s %s exceeded the fallback retry limit %d, pod is kept", kind, name, f.MaxRetries)
+		return
+	}
+
+	if restore != nil {
+		if err := template.patch(ctx, restore); err != nil {
+			log.Printf("Restore pod template of %s %s to fall back failed: %v", kind, name, err)
+			return
+		}
+		// The rollout of a Deployment replaces the pod, others keep it until deleted.
+		if kind != "Deployment" && !c.deletePod(ctx, pod) {
+			return
+		}
+		c.retries.Set(workload, retries+1, f.FailureTTL)
+		c.decide(pod, f, decisionTemplateRestored)
+		c.recorder.Eventf(pod, corev1.EventTypeNormal, ReasonFallbackTemplateRestored,
+			"Pod template of %s %s is restored to the original images to be rewritten without the failed mirror, retry %d/%d", kind, name, retries+1, f.MaxRetries)
+		return
+	}
+
+	if !c.deletePod(ctx, pod) {
+		return
+	}
+	c.retries.Set(workload, retries+1, f.FailureTTL)
+	c.decide(pod, f, decisionDeleted)
+	c.recorder.Eventf(pod, corev1.EventTypeNormal, ReasonFallbackPodDeleted,
+		"Pod is deleted to be recreated without the failed mirror, retry %d/%d of %s %s", retries+1, f.MaxRetries, kind, name)
+}
+
+// deletePod deletes the pod to be recreated by its workload, it reports whether
+// the pod is deleted or gone already.
+func (c *Controller) deletePod(ctx context.Context, pod *corev1.Pod) bool {
+	err := c.client.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{
+		Preconditions: metav1.NewUIDPreconditions(string(pod.UID)),
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		log.Printf("Delete pod %s/%s to fall back failed: %v", pod.Namespace, pod.Name, err)
+		return false
+	}
+	return true
+}
+
+// decide records the fallback decision of the pod
+func (c *Controller) decide(pod *corev1.Pod, f config.Fallback, decision string) {
+	c.handled.Set(pod.UID, struct{}{}, f.FailureTTL)
+	fallbackDecisions.WithLabelValues(decision).Inc()
+	log.Printf("Fall back pod %s/%s: %s", pod.Namespace, pod.Name, decision)
+}
+
+// failedImage returns the rewritten image as rendered by the mirror, the digest
+// pinned to the tag by registry-proxy is removed.
+func failedImage(image, original string) string {
+	if before, _, pinned := strings.Cut(image, "@"); pinned && strings.Contains(before, ":") && !strings.Contains(original, "@") {
+		return before
+	}
+	return image
+}
+
+// mirrorHost returns the host of the rewritten image
+func mirrorHost(image string) string {
+	host, _, _ := strings.Cut(image, "/")
+	return host
+}
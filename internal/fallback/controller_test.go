@@ -0,0 +1,210 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fallback
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ketches/registry-proxy/internal/config"
+	"github.com/ketches/registry-proxy/internal/global"
+	"github.com/ketches/registry-proxy/internal/health"
+	"github.com/ketches/registry-proxy/pkg/image"
+	"github.com/ketches/registry-proxy/pkg/util"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestReconcile(t *testing.T) {
+	config.Reset([]byte(`
+proxies:
+  docker.io:
+  - docker.linkos.org
+  - host: mirror.corp
+    priority: 1
+fallback:
+  enabled: true
+  after: 1m
+  maxRetries: 1
+`))
+	defer config.Reset(nil)
+
+	owner := []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web", UID: "rs", Controller: util.Ptr(true)}}
+	stuckPod := func(namespace, name string, owners []metav1.OwnerReference) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            name,
+				Namespace:       namespace,
+				UID:             types.UID(namespace + "/" + name),
+				Labels:          map[string]string{global.PodLabelProxied: "true"},
+				Annotations:     map[string]string{global.PodAnnotationOriginalImages: `{"app":"nginx:1.25"}`},
+				OwnerReferences: owners,
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "docker.linkos.org/library/nginx:1.25"}},
+			},
+			Status: corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{{
+					Name:  "app",
+					Image: "docker.linkos.org/library/nginx:1.25",
+					State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}},
+				}},
+			},
+		}
+	}
+	// the pod templates of the workloads in the namespace templates are rewritten,
+	// except the template of the ReplicaSet api, whose pods are rewritten on admission
+	template := func(record bool) corev1.PodTemplateSpec {
+		spec := corev1.PodTemplateSpec{
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "docker.linkos.org/library/nginx:1.25"}},
+			},
+		}
+		if record {
+			spec.Annotations = map[string]string{global.PodAnnotationOriginalImages: `{"app":"nginx:1.25"}`}
+		}
+		return spec
+	}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "templates", UID: "deployment"},
+		Spec:       appsv1.DeploymentSpec{Template: template(true)},
+	}
+	replicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "web",
+			Namespace:       "templates",
+			UID:             "rs",
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "web", UID: "deployment", Controller: util.Ptr(true)}},
+		},
+		Spec: appsv1.ReplicaSetSpec{Template: template(true)},
+	}
+	apiReplicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "templates", UID: "api"},
+		Spec:       appsv1.ReplicaSetSpec{Template: template(false)},
+	}
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "migrate", Namespace: "templates", UID: "job"},
+		Spec:       batchv1.JobSpec{Template: template(true)},
+	}
+	apiOwner := []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "api", UID: "api", Controller: util.Ptr(true)}}
+	jobOwner := []metav1.OwnerReference{{APIVersion: "batch/v1", Kind: "Job", Name: "migrate", UID: "job", Controller: util.Ptr(true)}}
+	client := fake.NewClientset(
+		stuckPod("default", "web-1", owner), stuckPod("default", "web-2", owner), stuckPod("default", "debug", nil),
+		stuckPod("templates", "web-1", owner), stuckPod("templates", "api-1", apiOwner), stuckPod("templates", "migrate-1", jobOwner),
+		deployment, replicaSet, apiReplicaSet, job,
+	)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	c := NewController(client)
+	recorder := record.NewFakeRecorder(16)
+	c.recorder = recorder
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	if !c.Start(stop) {
+		t.Fatalf("start controller failed")
+	}
+
+	ctx := context.Background()
+	c.Reconcile(ctx)
+	if len(recorder.Events) != 0 || health.IsImageFailed("docker.linkos.org/library/nginx:1.25") {
+		t.Fatalf("pods should not fall back before the configured duration")
+	}
+
+	now = now.Add(2 * time.Minute)
+	c.Reconcile(ctx)
+	if !health.IsImageFailed("docker.linkos.org/library/nginx:1.25") {
+		t.Errorf("stuck image should be marked failed")
+	}
+	ref, _ := image.ParseReference("nginx:1.25")
+	if result, _ := config.Rewrite(ref); result != "mirror.corp/library/nginx:1.25" {
+		t.Errorf("failed image should be rewritten to the next mirror, got: %s", result)
+	}
+
+	pods, _ := client.CoreV1().Pods("default").List(ctx, metav1.ListOptions{})
+	var names []string
+	for _, pod := range pods.Items {
+		names = append(names, pod.Name)
+	}
+	if len(names) != 2 || !strings.Contains(strings.Join(names, ","), "debug") {
+		t.Errorf("one controlled pod should be deleted within the retry limit, got pods: %v", names)
+	}
+	if _, err := client.CoreV1().Pods("templates").Get(ctx, "web-1", metav1.GetOptions{}); err != nil {
+		t.Errorf("pod of the restored Deployment should be kept for the rollout: %v", err)
+	}
+	if deployment, _ := client.AppsV1().Deployments("templates").Get(ctx, "web", metav1.GetOptions{}); deployment.Spec.Template.Spec.Containers[0].Image != "nginx:1.25" {
+		t.Errorf("rewritten pod template should be restored to the original image, got: %s", deployment.Spec.Template.Spec.Containers[0].Image)
+	}
+	if _, err := client.CoreV1().Pods("templates").Get(ctx, "api-1", metav1.GetOptions{}); err == nil {
+		t.Errorf("pod rewritten on admission should be deleted")
+	}
+	if apiReplicaSet, _ := client.AppsV1().ReplicaSets("templates").Get(ctx, "api", metav1.GetOptions{}); apiReplicaSet.Spec.Template.Spec.Containers[0].Image != "docker.linkos.org/library/nginx:1.25" {
+		t.Errorf("pod template without the record should not be patched, got: %s", apiReplicaSet.Spec.Template.Spec.Containers[0].Image)
+	}
+	if _, err := client.CoreV1().Pods("templates").Get(ctx, "migrate-1", metav1.GetOptions{}); err != nil {
+		t.Errorf("pod of the immutable rewritten pod template should be kept: %v", err)
+	}
+
+	reasons := make(map[string]int)
+	for len(recorder.Events) > 0 {
+		reasons[strings.Fields(<-recorder.Events)[1]]++
+	}
+	expected := map[string]int{
+		ReasonMirrorPullFailed:           6,
+		ReasonFallbackPodDeleted:         2,
+		ReasonFallbackRetryLimitExceeded: 1,
+		ReasonFallbackUncontrolled:       1,
+		ReasonFallbackWorkloadTemplate:   1,
+		ReasonFallbackTemplateRestored:   1,
+	}
+	for reason, count := range expected {
+		if reasons[reason] != count {
+			t.Errorf("expected %d %s events, got: %v", count, reason, reasons)
+		}
+	}
+
+	// handled pods are not fallen back again
+	c.Reconcile(ctx)
+	if len(recorder.Events) != 0 {
+		t.Errorf("handled pods should not fall back again, got event: %s", <-recorder.Events)
+	}
+}
+
+func TestFailedImage(t *testing.T) {
+	testdata := []struct {
+		image    string
+		original string
+		result   string
+	}{
+		{image: "mirror.corp/library/nginx:1.25", original: "nginx:1.25", result: "mirror.corp/library/nginx:1.25"},
+		{image: "mirror.corp/library/nginx:1.25@sha256:abc", original: "nginx:1.25", result: "mirror.corp/library/nginx:1.25"},
+		{image: "mirror.corp/library/nginx@sha256:abc", original: "nginx@sha256:abc", result: "mirror.corp/library/nginx@sha256:abc"},
+	}
+
+	for _, td := range testdata {
+		if result := failedImage(td.image, td.original); result != td.result {
+			t.Errorf("failed image of %s failed, expected: %s, got: %s", td.image, td.result, result)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fallback
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Decisions of the fallback controller on the pods with stuck images
+const (
+	decisionDeleted            = "deleted"
+	decisionRetryLimitExceeded = "retry_limit_exceeded"
+	decisionUncontrolled       = "uncontrolled"
+	decisionWorkloadTemplate   = "workload_template"
+	decisionTemplateRestored   = "template_restored"
+)
+
+var (
+	// imagePullFailures counts the rewritten images failed to be pulled, by mirror host
+	imagePullFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "registry_proxy_image_pull_failures_total",
+		Help: "Number of rewritten images stuck pulling from mirrors.",
+	}, []string{"mirror"})
+	// fallbackDecisions counts the fallback decisions, by decision
+	fallbackDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "registry_proxy_fallback_decisions_total",
+		Help: "Number of fallback decisions on pods with stuck images.",
+	}, []string{"decision"})
+)
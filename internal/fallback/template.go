@@ -0,0 +1,143 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fallback
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/ketches/registry-proxy/internal/annotation"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// workloadTemplate is the pod template of the workload which a pod is created from
+type workloadTemplate struct {
+	// kind and name are the kind and name of the workload
+	kind, name string
+	// template is the pod template of the workload
+	template *corev1.PodTemplateSpec
+	// patch applies the JSON patch to the workload, nil if the pod template is
+	// immutable, e.g. of Jobs
+	patch func(ctx context.Context, data []byte) error
+}
+
+// workloadTemplate returns the pod template of the workload controlling the pod,
+// the Deployment of a ReplicaSet owns its pod template. It is nil if the
+// workload is not found or of a kind whose template is unknown, e.g. the
+// ReplicaSets of Argo Rollouts carry the template of the Rollout.
+func (c *Controller) workloadTemplate(ctx context.Context, namespace string, owner *metav1.OwnerReference) (*workloadTemplate, error) {
+	var (
+		result *workloadTemplate
+		err    error
+	)
+	switch owner.Kind {
+	case "ReplicaSet":
+		var rs *appsv1.ReplicaSet
+		if rs, err = c.client.AppsV1().ReplicaSets(namespace).Get(ctx, owner.Name, metav1.GetOptions{}); err != nil {
+			break
+		}
+		if rsOwner := metav1.GetControllerOf(rs); rsOwner != nil {
+			if rsOwner.Kind != "Deployment" {
+				return nil, nil
+			}
+			var deployment *appsv1.Deployment
+			if deployment, err = c.client.AppsV1().Deployments(namespace).Get(ctx, rsOwner.Name, metav1.GetOptions{}); err != nil {
+				break
+			}
+			result = &workloadTemplate{kind: rsOwner.Kind, name: rsOwner.Name, template: &deployment.Spec.Template, patch: func(ctx context.Context, data []byte) error {
+				_, err := c.client.AppsV1().Deployments(namespace).Patch(ctx, rsOwner.Name, types.JSONPatchType, data, metav1.PatchOptions{})
+				return err
+			}}
+			break
+		}
+		result = &workloadTemplate{kind: owner.Kind, name: owner.Name, template: &rs.Spec.Template, patch: func(ctx context.Context, data []byte) error {
+			_, err := c.client.AppsV1().ReplicaSets(namespace).Patch(ctx, owner.Name, types.JSONPatchType, data, metav1.PatchOptions{})
+			return err
+		}}
+	case "StatefulSet":
+		var sts *appsv1.StatefulSet
+		if sts, err = c.client.AppsV1().StatefulSets(namespace).Get(ctx, owner.Name, metav1.GetOptions{}); err != nil {
+			break
+		}
+		result = &workloadTemplate{kind: owner.Kind, name: owner.Name, template: &sts.Spec.Template, patch: func(ctx context.Context, data []byte) error {
+			_, err := c.client.AppsV1().StatefulSets(namespace).Patch(ctx, owner.Name, types.JSONPatchType, data, metav1.PatchOptions{})
+			return err
+		}}
+	case "DaemonSet":
+		var ds *appsv1.DaemonSet
+		if ds, err = c.client.AppsV1().DaemonSets(namespace).Get(ctx, owner.Name, metav1.GetOptions{}); err != nil {
+			break
+		}
+		result = &workloadTemplate{kind: owner.Kind, name: owner.Name, template: &ds.Spec.Template, patch: func(ctx context.Context, data []byte) error {
+			_, err := c.client.AppsV1().DaemonSets(namespace).Patch(ctx, owner.Name, types.JSONPatchType, data, metav1.PatchOptions{})
+			return err
+		}}
+	case "Job":
+		var job *batchv1.Job
+		if job, err = c.client.BatchV1().Jobs(namespace).Get(ctx, owner.Name, metav1.GetOptions{}); err != nil {
+			break
+		}
+		result = &workloadTemplate{kind: owner.Kind, name: owner.Name, template: &job.Spec.Template}
+	}
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	return result, err
+}
+
+// restorePatch returns the JSON patch restoring the images of the stuck
+// containers in the pod template to their recorded originals, so that the
+// webhook rewrites them again without the failed mirrors. It is nil if the
+// template does not carry the rewritten images of the pod and their record,
+// i.e. the images are rewritten on the admission of the pod.
+func (t *workloadTemplate) restorePatch(pod *corev1.Pod, stuck []corev1.ContainerStatus) ([]byte, error) {
+	record := annotation.OriginalImages(t.template)
+	images := make(map[string]string)
+	for _, container := range slices.Concat(pod.Spec.InitContainers, pod.Spec.Containers) {
+		images[container.Name] = container.Image
+	}
+
+	var patches []map[string]any
+	for field, containers := range map[string][]corev1.Container{
+		"initContainers": t.template.Spec.InitContainers,
+		"containers":     t.template.Spec.Containers,
+	} {
+		for i, container := range containers {
+			original, ok := record[container.Name]
+			if !ok || original == container.Image || container.Image != images[container.Name] || !slices.ContainsFunc(stuck, func(status corev1.ContainerStatus) bool {
+				return status.Name == container.Name
+			}) {
+				continue
+			}
+			patches = append(patches,
+				map[string]any{"op": "test", "path": fmt.Sprintf("/spec/template/spec/%s/%d/image", field, i), "value": container.Image},
+				map[string]any{"op": "replace", "path": fmt.Sprintf("/spec/template/spec/%s/%d/image", field, i), "value": original},
+			)
+		}
+	}
+	if len(patches) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(patches)
+}
@@ -28,4 +28,38 @@ const (
 	WebhookServiceTLSCertFile = "tls.crt"
 	WebhookServiceTLSKeyFile  = "tls.key"
 	WebhookServicePath        = "/mutate"
+	WebhookTimeoutSeconds     = 5
+
+	// PodAnnotationSkip skips rewriting all images of the pod if set to "true"
+	PodAnnotationSkip = "registry-proxy.ketches.cn/skip"
+	// PodAnnotationSkipContainers skips rewriting images of the comma separated container names
+	PodAnnotationSkipContainers = "registry-proxy.ketches.cn/skip-containers"
+	// PodAnnotationMirror forces the mirror of the pod's images, the value is a comma
+	// separated list of `<registry>=<mirror>`, or a single mirror for all proxied images
+	PodAnnotationMirror = "registry-proxy.ketches.cn/mirror"
+
+	// PodAnnotationOriginalImages records the JSON map of container name to original image on rewritten pods
+	PodAnnotationOriginalImages = "registry-proxy.ketches.cn/original-images"
+	// PodAnnotationConfigGeneration records the generation of the config that rewrote the pod
+	PodAnnotationConfigGeneration = "registry-proxy.ketches.cn/config-generation"
+	// PodAnnotationMirroredRegistries records the JSON map of mirror host to original
+	// registry whose credentials are passed through by the mirror
+	PodAnnotationMirroredRegistries = "registry-proxy.ketches.cn/mirrored-registries"
+	// PodLabelProxied marks the rewritten pods with value "true"
+	PodLabelProxied = "registry-proxy.ketches.cn/proxied"
+
+	// PullSecretPrefix is the name prefix of the pull secrets replicated from the
+	// registry-proxy namespace to the namespaces of the rewritten pods
+	PullSecretPrefix = "registry-proxy-"
+	// MirroredPullSecretPrefix is the name prefix of the pull secrets derived from the
+	// image pull secrets of the rewritten pods, with the credentials of the original
+	// registries duplicated under the mirror hosts
+	MirroredPullSecretPrefix = "registry-proxy-mirrored-"
+	// SecretLabelManagedBy marks the secrets managed by registry-proxy with value TargetName
+	SecretLabelManagedBy = "app.kubernetes.io/managed-by"
+	// SecretAnnotationSource records the name of the source secret of a replicated secret
+	SecretAnnotationSource = "registry-proxy.ketches.cn/source"
+
+	// NamespaceProfileKey is the namespace label or annotation selecting the profile of its pods
+	NamespaceProfileKey = "registry-proxy.ketches.cn/profile"
 )
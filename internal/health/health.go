@@ -0,0 +1,100 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"log"
+	"maps"
+	"sync"
+	"time"
+)
+
+// State is the health state of a mirror host
+type State struct {
+	// Healthy reports whether the mirror is healthy
+	Healthy bool `json:"healthy"`
+	// StatusCode is the status code of the last probe, 0 if the probe failed
+	StatusCode int `json:"statusCode,omitempty"`
+	// Latency is the latency of the last probe
+	Latency time.Duration `json:"latency,omitempty"`
+	// Error is the error of the last failed probe
+	Error string `json:"error,omitempty"`
+	// LastProbeTime is the time of the last probe
+	LastProbeTime time.Time `json:"lastProbeTime,omitempty"`
+	// ConsecutiveFailures is the number of consecutive failed probes
+	ConsecutiveFailures int `json:"consecutiveFailures,omitempty"`
+}
+
+var (
+	mu sync.RWMutex
+	// states is the health states of the mirror hosts
+	states = make(map[string]State)
+)
+
+// IsHealthy reports whether the mirror host is healthy, hosts never marked are healthy.
+func IsHealthy(host string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	state, ok := states[host]
+	return !ok || state.Healthy
+}
+
+// GetStates returns a snapshot of the health states of the mirror hosts.
+func GetStates() map[string]State {
+	mu.RLock()
+	defer mu.RUnlock()
+	return maps.Clone(states)
+}
+
+// MarkUnhealthy marks the mirror host unhealthy.
+func MarkUnhealthy(host string) {
+	update(host, func(state *State) {
+		state.Healthy = false
+	})
+}
+
+// MarkHealthy marks the mirror host healthy.
+func MarkHealthy(host string) {
+	update(host, func(state *State) {
+		state.Healthy = true
+	})
+}
+
+// update updates the state of the mirror host and logs the health transition
+func update(host string, fn func(state *State)) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	state, ok := states[host]
+	if !ok {
+		state.Healthy = true
+	}
+	healthy := state.Healthy
+	fn(&state)
+	states[host] = state
+
+	if healthy != state.Healthy {
+		log.Printf("Mirror %s is marked %s", host, map[bool]string{true: "healthy", false: "unhealthy"}[state.Healthy])
+	}
+}
+
+// forget removes the state of the mirror host
+func forget(host string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(states, host)
+}
@@ -0,0 +1,45 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"log"
+	"time"
+
+	"github.com/ketches/registry-proxy/pkg/cache"
+)
+
+// failedImagesSize is the max number of failed images kept
+const failedImagesSize = 4096
+
+// failedImages is the rewritten images failed to be pulled from the mirrors
+var failedImages = cache.New[string, struct{}](failedImagesSize)
+
+// MarkImageFailed marks the rewritten image failed to be pulled from its mirror
+// for ttl, the mirror is skipped when rewriting the same image meanwhile.
+func MarkImageFailed(image string, ttl time.Duration) {
+	if !IsImageFailed(image) {
+		log.Printf("Image %s is marked failed for %s", image, ttl)
+	}
+	failedImages.Set(image, struct{}{}, ttl)
+}
+
+// IsImageFailed reports whether the rewritten image is marked failed.
+func IsImageFailed(image string) bool {
+	_, ok := failedImages.Get(image)
+	return ok
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	healthyDesc = prometheus.NewDesc("registry_proxy_mirror_healthy",
+		"Whether the mirror is healthy, 1 for healthy and 0 for unhealthy.", []string{"mirror"}, nil)
+	statusCodeDesc = prometheus.NewDesc("registry_proxy_mirror_probe_status_code",
+		"Status code of the last health probe of the mirror, 0 if the probe failed.", []string{"mirror"}, nil)
+	latencyDesc = prometheus.NewDesc("registry_proxy_mirror_probe_latency_seconds",
+		"Latency of the last health probe of the mirror.", []string{"mirror"}, nil)
+	failuresDesc = prometheus.NewDesc("registry_proxy_mirror_probe_consecutive_failures",
+		"Number of consecutive failed health probes of the mirror.", []string{"mirror"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(collector{})
+}
+
+// collector exports the health states of the mirrors as gauges
+type collector struct{}
+
+// Describe implements prometheus.Collector
+func (collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- healthyDesc
+	ch <- statusCodeDesc
+	ch <- latencyDesc
+	ch <- failuresDesc
+}
+
+// Collect implements prometheus.Collector
+func (collector) Collect(ch chan<- prometheus.Metric) {
+	for host, state := range GetStates() {
+		healthy := 0.0
+		if state.Healthy {
+			healthy = 1
+		}
+		ch <- prometheus.MustNewConstMetric(healthyDesc, prometheus.GaugeValue, healthy, host)
+		if state.LastProbeTime.IsZero() {
+			// marked without probing, e.g. in tests
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(statusCodeDesc, prometheus.GaugeValue, float64(state.StatusCode), host)
+		ch <- prometheus.MustNewConstMetric(latencyDesc, prometheus.GaugeValue, state.Latency.Seconds(), host)
+		ch <- prometheus.MustNewConstMetric(failuresDesc, prometheus.GaugeValue, float64(state.ConsecutiveFailures), host)
+	}
+}
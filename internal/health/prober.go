@@ -0,0 +1,185 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ketches/registry-proxy/pkg/registry"
+)
+
+// Target is a mirror host to probe
+type Target struct {
+	// Host is the mirror host, e.g. docker.linkos.org
+	Host string
+	// Interval is the interval of probes
+	Interval time.Duration
+	// Timeout is the timeout of a probe
+	Timeout time.Duration
+	// FailureThreshold is the number of consecutive failures to mark the mirror unhealthy
+	FailureThreshold int
+	// CABundle is the PEM encoded CA certificates trusted in addition to the system ones
+	CABundle string
+	// InsecureSkipVerify skips the verification of the mirror's certificate
+	InsecureSkipVerify bool
+}
+
+var (
+	probersMu sync.Mutex
+	// probers is the running probers keyed by mirror host
+	probers = make(map[string]*prober)
+)
+
+// prober probes a target periodically until stopped
+type prober struct {
+	target Target
+	client *http.Client
+	cancel context.CancelFunc
+}
+
+// SetTargets reconciles the running probers with the targets: probers of removed
+// or changed targets are stopped, and probers of new or changed targets are started.
+func SetTargets(targets []Target) {
+	probersMu.Lock()
+	defer probersMu.Unlock()
+
+	desired := make(map[string]Target, len(targets))
+	for _, target := range targets {
+		desired[target.Host] = target
+	}
+
+	for host, p := range probers {
+		if target, ok := desired[host]; !ok || target != p.target {
+			p.cancel()
+			delete(probers, host)
+			if !ok {
+				forget(host)
+			}
+		}
+	}
+
+	for host, target := range desired {
+		if _, ok := probers[host]; ok {
+			continue
+		}
+		p, err := newProber(target)
+		if err != nil {
+			log.Printf("Start health check of mirror %s failed: %v", host, err)
+			continue
+		}
+		probers[host] = p
+	}
+}
+
+// AddTarget starts probing the target if its host is not probed yet, e.g. the
+// mirrors discovered at runtime.
+func AddTarget(target Target) {
+	probersMu.Lock()
+	defer probersMu.Unlock()
+
+	if _, ok := probers[target.Host]; ok {
+		return
+	}
+	p, err := newProber(target)
+	if err != nil {
+		log.Printf("Start health check of mirror %s failed: %v", target.Host, err)
+		return
+	}
+	probers[target.Host] = p
+}
+
+// newProber creates and starts a prober of the target
+func newProber(target Target) (*prober, error) {
+	transport, err := registry.NewTransport(target.CABundle, target.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &prober{
+		target: target,
+		client: &http.Client{Transport: transport, Timeout: target.Timeout},
+		cancel: cancel,
+	}
+	go p.run(ctx)
+	return p, nil
+}
+
+// run probes the target every interval until the context is done
+func (p *prober) run(ctx context.Context) {
+	ticker := time.NewTicker(p.target.Interval)
+	defer ticker.Stop()
+
+	for {
+		p.probe(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe calls `GET /v2/` of the target and records the result. The mirror is
+// alive if it responds 200 or 401, since most registries require a token.
+func (p *prober) probe(ctx context.Context) {
+	var (
+		start      = time.Now()
+		statusCode int
+		err        error
+	)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://%s/v2/", registry.APIHost(p.target.Host)), nil)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = p.client.Do(req); err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			statusCode = resp.StatusCode
+			if statusCode != http.StatusOK && statusCode != http.StatusUnauthorized {
+				err = fmt.Errorf("unexpected status %s", resp.Status)
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		// stopped during the probe
+		return
+	}
+
+	update(p.target.Host, func(state *State) {
+		state.StatusCode = statusCode
+		state.Latency = time.Since(start)
+		state.LastProbeTime = start
+		if err != nil {
+			state.Error = err.Error()
+			state.ConsecutiveFailures++
+			if state.ConsecutiveFailures >= p.target.FailureThreshold {
+				state.Healthy = false
+			}
+			return
+		}
+		state.Error = ""
+		state.ConsecutiveFailures = 0
+		state.Healthy = true
+	})
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProber(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/" {
+			t.Errorf("unexpected probe path: %s", r.URL.Path)
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "https://")
+	SetTargets([]Target{{
+		Host:               host,
+		Interval:           10 * time.Millisecond,
+		Timeout:            time.Second,
+		FailureThreshold:   3,
+		InsecureSkipVerify: true,
+	}})
+	defer SetTargets(nil)
+
+	waitFor := func(healthy bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for IsHealthy(host) != healthy {
+			if time.Now().After(deadline) {
+				t.Fatalf("mirror %s should be healthy: %v, state: %+v", host, healthy, GetStates()[host])
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitFor(false)
+	if state := GetStates()[host]; state.ConsecutiveFailures < 3 || state.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("unexpected state of unhealthy mirror: %+v", state)
+	}
+
+	// registries requiring a token are alive
+	status.Store(http.StatusUnauthorized)
+	waitFor(true)
+
+	expected := fmt.Sprintf(`
+# HELP registry_proxy_mirror_healthy Whether the mirror is healthy, 1 for healthy and 0 for unhealthy.
+# TYPE registry_proxy_mirror_healthy gauge
+registry_proxy_mirror_healthy{mirror="%s"} 1
+`, host)
+	if err := testutil.CollectAndCompare(collector{}, strings.NewReader(expected), "registry_proxy_mirror_healthy"); err != nil {
+		t.Errorf("unexpected health metrics: %v", err)
+	}
+
+	SetTargets(nil)
+	if _, ok := GetStates()[host]; ok {
+		t.Errorf("state of removed target should be forgotten")
+	}
+}
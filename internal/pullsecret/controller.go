@@ -0,0 +1,362 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pullsecret
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ketches/registry-proxy/internal/annotation"
+	"github.com/ketches/registry-proxy/internal/config"
+	"github.com/ketches/registry-proxy/internal/global"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// resyncPeriod is the period of the full reconciliation
+const resyncPeriod = 5 * time.Minute
+
+// Controller replicates the source pull secrets of the mirrors into the
+// namespaces of the pods referencing them, derives the pull secrets of the
+// mirrors passing the credentials through from the image pull secrets of the
+// pods, keeps them in sync with the sources, and garbage-collects those no pod
+// references any more.
+type Controller struct {
+	client kubernetes.Interface
+	// namespace is the namespace of the source secrets
+	namespace string
+
+	factories   []informers.SharedInformerFactory
+	pods        listerscorev1.PodLister
+	sources     listerscorev1.SecretLister
+	credentials listerscorev1.SecretLister
+	replicas    listerscorev1.SecretLister
+
+	// trigger coalesces the reconciliation requests
+	trigger chan struct{}
+}
+
+// NewCredentialInformerFactory returns the informer factory of the dockerconfigjson
+// secrets in all namespaces, the credentials of the image pull secrets of pods.
+func NewCredentialInformerFactory(client kubernetes.Interface) informers.SharedInformerFactory {
+	return informers.NewSharedInformerFactoryWithOptions(client, resyncPeriod, dockerConfigJSONOnly)
+}
+
+// dockerConfigJSONOnly filters the secrets of an informer factory by the dockerconfigjson type
+var dockerConfigJSONOnly = informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+	options.FieldSelector = fields.OneTermEqualSelector("type", string(corev1.SecretTypeDockerConfigJson)).String()
+})
+
+// NewController returns a controller of the source secrets in the namespace.
+// Only the rewritten pods are watched, the replicas are found by the managed-by label.
+// The credential factory is shared with the webhook, see NewCredentialInformerFactory.
+func NewController(client kubernetes.Interface, namespace string, credentialFactory informers.SharedInformerFactory) *Controller {
+	c := &Controller{
+		client:    client,
+		namespace: namespace,
+		trigger:   make(chan struct{}, 1),
+	}
+
+	podFactory := informers.NewSharedInformerFactoryWithOptions(client, resyncPeriod, informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.LabelSelector = global.PodLabelProxied + "=true"
+	}))
+	sourceFactory := informers.NewSharedInformerFactoryWithOptions(client, resyncPeriod, informers.WithNamespace(namespace), dockerConfigJSONOnly)
+	replicaFactory := informers.NewSharedInformerFactoryWithOptions(client, resyncPeriod, informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.LabelSelector = global.SecretLabelManagedBy + "=" + global.TargetName
+	}))
+	c.factories = []informers.SharedInformerFactory{podFactory, sourceFactory, credentialFactory, replicaFactory}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(any) { c.Trigger() },
+		UpdateFunc: func(any, any) { c.Trigger() },
+		DeleteFunc: func(any) { c.Trigger() },
+	}
+	for _, informer := range []cache.SharedIndexInformer{
+		podFactory.Core().V1().Pods().Informer(),
+		sourceFactory.Core().V1().Secrets().Informer(),
+		credentialFactory.Core().V1().Secrets().Informer(),
+		replicaFactory.Core().V1().Secrets().Informer(),
+	} {
+		informer.AddEventHandler(handler)
+	}
+	c.pods = podFactory.Core().V1().Pods().Lister()
+	c.sources = sourceFactory.Core().V1().Secrets().Lister()
+	c.credentials = credentialFactory.Core().V1().Secrets().Lister()
+	c.replicas = replicaFactory.Core().V1().Secrets().Lister()
+	return c
+}
+
+// Trigger requests a reconciliation, requests are coalesced while one is pending.
+func (c *Controller) Trigger() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Start starts the informers and waits for the caches to be synced, starting the
+// shared credential factory again is a no-op.
+func (c *Controller) Start(stop <-chan struct{}) bool {
+	for _, factory := range c.factories {
+		factory.Start(stop)
+	}
+	for _, factory := range c.factories {
+		for _, synced := range factory.WaitForCacheSync(stop) {
+			if !synced {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Run starts the controller and reconciles on every change until stop is closed.
+func (c *Controller) Run(stop <-chan struct{}) {
+	if !c.Start(stop) {
+		log.Println("Pull secret controller failed to sync caches.")
+		return
+	}
+	log.Println("Pull secret controller started")
+
+	ticker := time.NewTicker(resyncPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-c.trigger:
+		case <-ticker.C:
+		}
+		c.Reconcile(context.Background())
+	}
+}
+
+// Reconcile replicates the referenced source secrets, and deletes the replicas
+// not referenced by any rewritten pod.
+func (c *Controller) Reconcile(ctx context.Context) {
+	desired, err := c.desiredSecrets()
+	if err != nil {
+		log.Printf("List desired pull secrets failed: %v", err)
+		return
+	}
+	for _, secret := range desired {
+		c.apply(ctx, secret)
+	}
+
+	replicas, err := c.replicas.List(labels.Everything())
+	if err != nil {
+		log.Printf("List replicated pull secrets failed: %v", err)
+		return
+	}
+	for _, replica := range replicas {
+		if _, ok := desired[cache.NewObjectName(replica.Namespace, replica.Name)]; ok || !managed(replica) {
+			continue
+		}
+		err := c.client.CoreV1().Secrets(replica.Namespace).Delete(ctx, replica.Name, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			log.Printf("Delete pull secret %s/%s failed: %v", replica.Namespace, replica.Name, err)
+			continue
+		}
+		log.Printf("Delete pull secret %s/%s not referenced by any pod", replica.Namespace, replica.Name)
+	}
+}
+
+// desiredSecrets returns the replicas of the source secrets and the derived
+// secrets referenced by the image pull secrets of the rewritten pods, keyed by
+// namespace and name.
+func (c *Controller) desiredSecrets() (map[cache.ObjectName]*corev1.Secret, error) {
+	pods, err := c.pods.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	desired := make(map[cache.ObjectName]*corev1.Secret)
+	// mirrored is the mirrored registries of the derived secrets
+	mirrored := make(map[cache.ObjectName]map[string]string)
+	for _, pod := range pods {
+		if pod.Namespace == c.namespace {
+			continue
+		}
+		for _, ref := range pod.Spec.ImagePullSecrets {
+			key := cache.NewObjectName(pod.Namespace, ref.Name)
+			if strings.HasPrefix(ref.Name, global.MirroredPullSecretPrefix) {
+				if mirrored[key] == nil {
+					mirrored[key] = make(map[string]string)
+				}
+				maps.Copy(mirrored[key], annotation.MirroredRegistries(pod))
+				continue
+			}
+			source, ok := strings.CutPrefix(ref.Name, global.PullSecretPrefix)
+			if _, exists := desired[key]; !ok || exists {
+				continue
+			}
+			// only the pull secrets of the configured mirrors are replicated, never
+			// any secret of the namespace the pod happens to reference
+			if !config.IsPullSecret(source) {
+				log.Printf("Pull secret %s of pod %s/%s is not the pull secret of any mirror, skip", ref.Name, pod.Namespace, pod.Name)
+				continue
+			}
+			secret, err := c.sources.Secrets(c.namespace).Get(source)
+			if err != nil {
+				if errors.IsNotFound(err) {
+					log.Printf("Source pull secret %s/%s of pod %s/%s not found", c.namespace, source, pod.Namespace, pod.Name)
+				}
+				continue
+			}
+			if secret.Type != corev1.SecretTypeDockerConfigJson {
+				log.Printf("Source pull secret %s/%s of pod %s/%s has unsupported type %s, skip", c.namespace, source, pod.Namespace, pod.Name, secret.Type)
+				continue
+			}
+			desired[key] = replicate(secret, pod.Namespace)
+		}
+	}
+
+	for key, registries := range mirrored {
+		name := strings.TrimPrefix(key.Name, global.MirroredPullSecretPrefix)
+		source, err := c.credentials.Secrets(key.Namespace).Get(name)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				log.Printf("Source pull secret %s/%s of %s not found", key.Namespace, name, key.Name)
+			}
+			continue
+		}
+		secret, err := derive(source, registries)
+		if err != nil {
+			log.Printf("Derive pull secret %s from %s/%s failed: %v", key.Name, key.Namespace, name, err)
+			continue
+		}
+		desired[key] = secret
+	}
+	return desired, nil
+}
+
+// derive returns the secret derived from the source dockerconfigjson secret, the
+// auths of the original registries are duplicated under the mirror hosts. The
+// registries is the map of mirror host to original registry.
+func derive(source *corev1.Secret, registries map[string]string) (*corev1.Secret, error) {
+	if source.Type != corev1.SecretTypeDockerConfigJson {
+		return nil, fmt.Errorf("unsupported secret type %s", source.Type)
+	}
+	var in dockerConfig
+	if err := json.Unmarshal(source.Data[corev1.DockerConfigJsonKey], &in); err != nil {
+		return nil, err
+	}
+
+	out := dockerConfig{Auths: make(map[string]json.RawMessage)}
+	for key, auth := range in.Auths {
+		registry, path := splitAuthKey(key)
+		for host, original := range registries {
+			if original == registry {
+				out.Auths[host+path] = auth
+			}
+		}
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := replicate(source, source.Namespace)
+	secret.Name = global.MirroredPullSecretPrefix + source.Name
+	secret.Data = map[string][]byte{corev1.DockerConfigJsonKey: data}
+	return secret, nil
+}
+
+// replicate returns the replica of the source secret in the namespace
+func replicate(source *corev1.Secret, namespace string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      global.PullSecretPrefix + source.Name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				global.SecretLabelManagedBy: global.TargetName,
+			},
+			Annotations: map[string]string{
+				global.SecretAnnotationSource: source.Namespace + "/" + source.Name,
+			},
+		},
+		Type: source.Type,
+		Data: maps.Clone(source.Data),
+	}
+}
+
+// managed reports whether the secret is a replica managed by the controller,
+// the informer filters by the label already, this guards against the others.
+func managed(secret *corev1.Secret) bool {
+	return secret.Labels[global.SecretLabelManagedBy] == global.TargetName
+}
+
+// apply creates the secret, or updates it if the data differs
+func (c *Controller) apply(ctx context.Context, secret *corev1.Secret) {
+	current, err := c.replicas.Secrets(secret.Namespace).Get(secret.Name)
+	if err == nil && !managed(current) {
+		err = errors.NewNotFound(corev1.Resource("secrets"), secret.Name)
+	}
+	if errors.IsNotFound(err) {
+		_, err = c.client.CoreV1().Secrets(secret.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+		if errors.IsAlreadyExists(err) {
+			log.Printf("Pull secret %s/%s exists but is not managed by registry-proxy, skip", secret.Namespace, secret.Name)
+			return
+		}
+		if err != nil {
+			log.Printf("Create pull secret %s/%s failed: %v", secret.Namespace, secret.Name, err)
+			return
+		}
+		log.Printf("Create pull secret %s/%s", secret.Namespace, secret.Name)
+		return
+	}
+	if err != nil {
+		log.Printf("Get pull secret %s/%s failed: %v", secret.Namespace, secret.Name, err)
+		return
+	}
+
+	source := secret.Annotations[global.SecretAnnotationSource]
+	if current.Type == secret.Type && reflect.DeepEqual(current.Data, secret.Data) && current.Annotations[global.SecretAnnotationSource] == source {
+		return
+	}
+	// the type of a secret is immutable
+	if current.Type != secret.Type {
+		if err := c.client.CoreV1().Secrets(secret.Namespace).Delete(ctx, secret.Name, metav1.DeleteOptions{}); err != nil {
+			log.Printf("Delete pull secret %s/%s failed: %v", secret.Namespace, secret.Name, err)
+		}
+		return
+	}
+	updated := current.DeepCopy()
+	updated.Data = secret.Data
+	if updated.Annotations == nil {
+		updated.Annotations = make(map[string]string)
+	}
+	updated.Annotations[global.SecretAnnotationSource] = source
+	if _, err := c.client.CoreV1().Secrets(secret.Namespace).Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		log.Printf("Update pull secret %s/%s failed: %v", secret.Namespace, secret.Name, err)
+		return
+	}
+	log.Printf("Update pull secret %s/%s", secret.Namespace, secret.Name)
+}
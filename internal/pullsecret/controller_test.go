@@ -0,0 +1,170 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pullsecret
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ketches/registry-proxy/internal/config"
+	"github.com/ketches/registry-proxy/internal/global"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	managed := map[string]string{global.SecretLabelManagedBy: global.TargetName}
+	proxied := map[string]string{global.PodLabelProxied: "true"}
+	config.Reset([]byte(`
+proxies:
+  docker.io:
+    host: mirror.corp
+    pullSecret: corp
+  quay.io:
+    host: quay.corp
+    pullSecret: opaque
+`))
+	defer config.Reset(nil)
+
+	client := fake.NewClientset(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "corp", Namespace: global.TargetNamespace},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths":{"mirror.corp":{"auth":"dXNlcjpwYXNz"}}}`)},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "own", Namespace: "team-a"},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths":{"https://ghcr.io":{"auth":"Z2hjcjpwYXNz"},"quay.io":{"auth":"cXVheTpwYXNz"}}}`)},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "app",
+				Namespace:   "team-a",
+				Labels:      proxied,
+				Annotations: map[string]string{global.PodAnnotationMirroredRegistries: `{"ghcr.linkos.org":"ghcr.io"}`},
+			},
+			Spec: corev1.PodSpec{ImagePullSecrets: []corev1.LocalObjectReference{{Name: "registry-proxy-corp"}, {Name: "own"}, {Name: "registry-proxy-mirrored-own"}}},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team-b", Labels: proxied},
+			Spec:       corev1.PodSpec{ImagePullSecrets: []corev1.LocalObjectReference{{Name: "registry-proxy-missing"}}},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: global.WebhookTLSCertSecretName, Namespace: global.TargetNamespace},
+			Type:       corev1.SecretTypeTLS,
+			Data:       map[string][]byte{corev1.TLSPrivateKeyKey: []byte("key")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "opaque", Namespace: global.TargetNamespace},
+			Type:       corev1.SecretTypeOpaque,
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "attacker", Namespace: "team-d", Labels: proxied},
+			Spec:       corev1.PodSpec{ImagePullSecrets: []corev1.LocalObjectReference{{Name: "registry-proxy-registry-proxy-webhook-tls"}, {Name: "registry-proxy-opaque"}}},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "registry-proxy-corp", Namespace: "team-c", Labels: managed},
+			Type:       corev1.SecretTypeDockerConfigJson,
+		},
+	)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	c := NewController(client, global.TargetNamespace, NewCredentialInformerFactory(client))
+	if !c.Start(stop) {
+		t.Fatalf("start controller failed")
+	}
+	c.Reconcile(ctx)
+
+	replica, err := client.CoreV1().Secrets("team-a").Get(ctx, "registry-proxy-corp", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("pull secret should be replicated to team-a: %v", err)
+	}
+	if replica.Labels[global.SecretLabelManagedBy] != global.TargetName || replica.Type != corev1.SecretTypeDockerConfigJson {
+		t.Errorf("replicated pull secret should be managed by registry-proxy, got: %+v", replica.ObjectMeta)
+	}
+	derived, err := client.CoreV1().Secrets("team-a").Get(ctx, "registry-proxy-mirrored-own", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("mirrored pull secret should be derived in team-a: %v", err)
+	}
+	if result := string(derived.Data[corev1.DockerConfigJsonKey]); result != `{"auths":{"ghcr.linkos.org":{"auth":"Z2hjcjpwYXNz"}}}` {
+		t.Errorf("mirrored pull secret should duplicate the auths under the mirror host, got: %s", result)
+	}
+	if _, err := client.CoreV1().Secrets("team-b").Get(ctx, "registry-proxy-missing", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("pull secret without source should not be replicated, got: %v", err)
+	}
+	if _, err := client.CoreV1().Secrets("team-d").Get(ctx, "registry-proxy-registry-proxy-webhook-tls", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("secret which is not the pull secret of any mirror should not be replicated, got: %v", err)
+	}
+	if _, err := client.CoreV1().Secrets("team-d").Get(ctx, "registry-proxy-opaque", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("pull secret which is not dockerconfigjson should not be replicated, got: %v", err)
+	}
+	if _, err := client.CoreV1().Secrets("team-c").Get(ctx, "registry-proxy-corp", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("pull secret not referenced by any pod should be deleted, got: %v", err)
+	}
+
+	// the replica is kept in sync with the source
+	source, _ := client.CoreV1().Secrets(global.TargetNamespace).Get(ctx, "corp", metav1.GetOptions{})
+	source.Data[corev1.DockerConfigJsonKey] = []byte(`{"auths":{"mirror.corp":{"auth":"dXNlcjpuZXc="}}}`)
+	client.CoreV1().Secrets(global.TargetNamespace).Update(ctx, source, metav1.UpdateOptions{})
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		c.Reconcile(ctx)
+		replica, err := client.CoreV1().Secrets("team-a").Get(ctx, "registry-proxy-corp", metav1.GetOptions{})
+		return err == nil && string(replica.Data[corev1.DockerConfigJsonKey]) == string(source.Data[corev1.DockerConfigJsonKey]), nil
+	})
+	if err != nil {
+		t.Errorf("replicated pull secret should be updated with the source: %v", err)
+	}
+
+	// the replica is deleted once no pod references it
+	client.CoreV1().Pods("team-a").Delete(ctx, "app", metav1.DeleteOptions{})
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		c.Reconcile(ctx)
+		_, err := client.CoreV1().Secrets("team-a").Get(ctx, "registry-proxy-corp", metav1.GetOptions{})
+		_, derivedErr := client.CoreV1().Secrets("team-a").Get(ctx, "registry-proxy-mirrored-own", metav1.GetOptions{})
+		return errors.IsNotFound(err) && errors.IsNotFound(derivedErr), nil
+	})
+	if err != nil {
+		t.Errorf("replicated and mirrored pull secrets should be deleted with the last pod: %v", err)
+	}
+}
+
+func TestSplitAuthKey(t *testing.T) {
+	testdata := []struct {
+		key      string
+		registry string
+		path     string
+	}{
+		{key: "https://index.docker.io/v1/", registry: "docker.io", path: ""},
+		{key: "docker.io", registry: "docker.io", path: ""},
+		{key: "https://ghcr.io", registry: "ghcr.io", path: ""},
+		{key: "ghcr.io/org", registry: "ghcr.io", path: "/org"},
+		{key: "http://registry.corp:5000/v2/", registry: "registry.corp:5000", path: ""},
+	}
+
+	for _, td := range testdata {
+		if registry, path := splitAuthKey(td.key); registry != td.registry || path != td.path {
+			t.Errorf("split %s failed, expected: %s %s, got: %s %s", td.key, td.registry, td.path, registry, path)
+		}
+	}
+}
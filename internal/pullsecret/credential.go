@@ -0,0 +1,70 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pullsecret
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"github.com/ketches/registry-proxy/internal/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// dockerConfig is the content of a dockerconfigjson secret
+type dockerConfig struct {
+	Auths map[string]json.RawMessage `json:"auths"`
+}
+
+// CredentialKeys returns the keys of the credentials in the docker config secret,
+// each key is the canonical registry optionally followed by a path, e.g. docker.io
+// or ghcr.io/org. It is empty if the secret is not a docker config secret.
+func CredentialKeys(secret *corev1.Secret) []string {
+	var auths map[string]json.RawMessage
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		var in dockerConfig
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &in); err != nil {
+			return nil
+		}
+		auths = in.Auths
+	case corev1.SecretTypeDockercfg:
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &auths); err != nil {
+			return nil
+		}
+	}
+
+	var keys []string
+	for key := range auths {
+		registry, path := splitAuthKey(key)
+		keys = append(keys, registry+path)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// splitAuthKey splits the key of docker config auths into the canonical registry
+// and the path, e.g. https://index.docker.io/v1/ is docker.io with empty path,
+// ghcr.io/org is ghcr.io with path /org.
+func splitAuthKey(key string) (registry, path string) {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	registry, path, _ = strings.Cut(strings.TrimSuffix(key, "/"), "/")
+	if path = "/" + path; path == "/" || path == "/v1" || path == "/v2" {
+		path = ""
+	}
+	return config.CanonicalRegistry(registry), path
+}
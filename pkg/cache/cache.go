@@ -0,0 +1,97 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache is a size bounded cache with per entry TTL, the least recently used
+// entry is evicted when the cache is full.
+type Cache[K comparable, V any] struct {
+	mu      sync.Mutex
+	size    int
+	entries map[K]*list.Element
+	lru     *list.List
+}
+
+// entry is the cache entry stored in the lru list
+type entry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+}
+
+// New returns a cache holding at most size entries.
+func New[K comparable, V any](size int) *Cache[K, V] {
+	return &Cache[K, V]{
+		size:    size,
+		entries: make(map[K]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Get returns the value of key, ok is false if the key is absent or expired.
+func (c *Cache[K, V]) Get(key K) (value V, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return value, false
+	}
+	e := elem.Value.(*entry[K, V])
+	if time.Now().After(e.expires) {
+		c.remove(elem)
+		return value, false
+	}
+	c.lru.MoveToFront(elem)
+	return e.value, true
+}
+
+// Set sets the value of key which expires after ttl.
+func (c *Cache[K, V]) Set(key K, value V, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		e := elem.Value.(*entry[K, V])
+		e.value, e.expires = value, time.Now().Add(ttl)
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&entry[K, V]{key: key, value: value, expires: time.Now().Add(ttl)})
+	for c.size > 0 && c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Len returns the number of entries in the cache, including expired ones not yet evicted.
+func (c *Cache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// remove removes the element from the cache
+func (c *Cache[K, V]) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*entry[K, V]).key)
+}
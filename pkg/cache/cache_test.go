@@ -0,0 +1,73 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheExpiry(t *testing.T) {
+	c := New[string, string](10)
+	c.Set("short", "value", 20*time.Millisecond)
+	c.Set("long", "value", time.Hour)
+
+	if _, ok := c.Get("short"); !ok {
+		t.Errorf("entry should be cached before it expires")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := c.Get("short"); ok {
+		t.Errorf("entry should expire after ttl")
+	}
+	if _, ok := c.Get("long"); !ok {
+		t.Errorf("entry not expired should be kept")
+	}
+	if c.Len() != 1 {
+		t.Errorf("expired entry should be removed on get, got %d entries", c.Len())
+	}
+
+	// setting an existing key refreshes its value and ttl
+	c.Set("long", "updated", 20*time.Millisecond)
+	if value, _ := c.Get("long"); value != "updated" {
+		t.Errorf("entry should be updated, got: %s", value)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := c.Get("long"); ok {
+		t.Errorf("updated entry should expire after the new ttl")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := New[string, int](2)
+	c.Set("a", 1, time.Hour)
+	c.Set("b", 2, time.Hour)
+	// a is used recently, b is the least recently used
+	c.Get("a")
+	c.Set("c", 3, time.Hour)
+
+	if c.Len() != 2 {
+		t.Errorf("cache should hold at most 2 entries, got %d", c.Len())
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("least recently used entry should be evicted")
+	}
+	for key, expected := range map[string]int{"a": 1, "c": 3} {
+		if value, ok := c.Get(key); !ok || value != expected {
+			t.Errorf("entry %s should be kept, expected: %d, got: %d", key, expected, value)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fieldpath
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// segment is a segment of the path, a field of an object optionally followed by
+// all items of the array in the field.
+type segment struct {
+	field string
+	items bool
+}
+
+// Path is a JSONPath-style field path, e.g. .spec.steps[*].image, each segment
+// is a field name optionally followed by [*] selecting all items of an array.
+type Path struct {
+	raw      string
+	segments []segment
+}
+
+// Parse parses the path, the leading dot is optional.
+func Parse(path string) (Path, error) {
+	result := Path{raw: path}
+	for _, s := range strings.Split(strings.TrimPrefix(path, "."), ".") {
+		field, items := strings.CutSuffix(s, "[*]")
+		if field == "" || strings.ContainsAny(field, "[]*") {
+			return Path{}, fmt.Errorf("invalid path %q: invalid segment %q", path, s)
+		}
+		result.segments = append(result.segments, segment{field: field, items: items})
+	}
+	return result, nil
+}
+
+// String returns the raw path
+func (p Path) String() string {
+	return p.raw
+}
+
+// Walk calls fn with the JSON pointer and the value of every string field of
+// the object matched by the path, absent fields and fields of other types are
+// ignored.
+func (p Path) Walk(obj map[string]any, fn func(pointer, value string)) {
+	walk(obj, "", p.segments, fn)
+}
+
+// walk walks the value at the pointer with the remaining segments
+func walk(value any, pointer string, segments []segment, fn func(pointer, value string)) {
+	if len(segments) == 0 {
+		if s, ok := value.(string); ok {
+			fn(pointer, s)
+		}
+		return
+	}
+
+	obj, ok := value.(map[string]any)
+	if !ok {
+		return
+	}
+	s := segments[0]
+	field, ok := obj[s.field]
+	if !ok {
+		return
+	}
+	pointer += "/" + EscapePointer(s.field)
+	if !s.items {
+		walk(field, pointer, segments[1:], fn)
+		return
+	}
+	items, _ := field.([]any)
+	for i, item := range items {
+		walk(item, pointer+"/"+strconv.Itoa(i), segments[1:], fn)
+	}
+}
+
+// EscapePointer escapes the reference token of a JSON pointer, see RFC 6901
+func EscapePointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fieldpath
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	testdata := []struct {
+		path  string
+		valid bool
+	}{
+		{path: ".spec.steps[*].image", valid: true},
+		{path: "spec.template.spec.volumes[*].containerDisk.image", valid: true},
+		{path: ".spec..image", valid: false},
+		{path: ".spec.steps[0].image", valid: false},
+		{path: ".spec.*.image", valid: false},
+		{path: "", valid: false},
+	}
+
+	for _, td := range testdata {
+		_, err := Parse(td.path)
+		if (err == nil) != td.valid {
+			t.Errorf("parse path %s failed, expected valid: %v, got error: %v", td.path, td.valid, err)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	var obj map[string]any
+	json.Unmarshal([]byte(`{
+  "spec": {
+    "steps": [
+      {"name": "build", "image": "golang:1.22"},
+      {"name": "noop"},
+      {"name": "push", "image": "gcr.io/kaniko-project/executor:latest"}
+    ],
+    "metadata": {"a/b~c": {"image": "busybox"}},
+    "replicas": 1
+  }
+}`), &obj)
+
+	testdata := []struct {
+		path     string
+		expected map[string]string
+	}{
+		{
+			path: ".spec.steps[*].image",
+			expected: map[string]string{
+				"/spec/steps/0/image": "golang:1.22",
+				"/spec/steps/2/image": "gcr.io/kaniko-project/executor:latest",
+			},
+		}, {
+			path:     ".spec.metadata.a/b~c.image",
+			expected: map[string]string{"/spec/metadata/a~1b~0c/image": "busybox"},
+		}, {
+			path:     ".spec.replicas",
+			expected: map[string]string{},
+		}, {
+			path:     ".spec.sidecars[*].image",
+			expected: map[string]string{},
+		},
+	}
+
+	for _, td := range testdata {
+		p, err := Parse(td.path)
+		if err != nil {
+			t.Fatalf("parse path %s failed: %v", td.path, err)
+		}
+		got := make(map[string]string)
+		p.Walk(obj, func(pointer, value string) {
+			got[pointer] = value
+		})
+		if !reflect.DeepEqual(got, td.expected) {
+			t.Errorf("walk path %s failed, expected: %v, got: %v", td.path, td.expected, got)
+		}
+	}
+}
@@ -18,6 +18,7 @@ package image
 
 import (
 	"log"
+	"path"
 	"strings"
 
 	"github.com/containers/image/docker/reference"
@@ -35,3 +36,98 @@ func Parse(image string) (registry, name string, err error) {
 	name = strings.TrimPrefix(reference.TagNameOnly(named).String(), registry+"/")
 	return
 }
+
+// Reference is a parsed image reference.
+type Reference struct {
+	// Registry is the registry domain, e.g. docker.io
+	Registry string
+	// Repository is the repository path without registry, e.g. library/nginx
+	Repository string
+	// Tag is the tag of the image, latest if the image has neither tag nor digest
+	Tag string
+	// Digest is the digest of the image
+	Digest string
+	// ImplicitTag reports whether the tag is the implicit latest tag
+	ImplicitTag bool
+}
+
+// RenderOptions is the options of rendering the name of a reference.
+type RenderOptions struct {
+	// OfficialPrefix is the repository prefix of Docker Hub official images,
+	// nil keeps the library prefix, empty renders the short form, e.g. nginx.
+	OfficialPrefix *string
+	// OmitImplicitTag omits the implicit latest tag.
+	OmitImplicitTag bool
+}
+
+// ParseReference parses the image into a reference, Docker Hub images are
+// normalized as Parse does, tag and digest are both kept.
+func ParseReference(image string) (*Reference, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		log.Println("Parse image failed.", err.Error(), image)
+		return nil, err
+	}
+
+	result := &Reference{
+		Registry:   reference.Domain(named),
+		Repository: reference.Path(named),
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		result.Tag = tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		result.Digest = digested.Digest().String()
+	}
+	if reference.IsNameOnly(named) {
+		result.Tag, result.ImplicitTag = "latest", true
+	}
+	return result, nil
+}
+
+// Qualified reports whether the image name is qualified with a registry domain,
+// the first path component is a domain if it contains "." or ":", is localhost
+// or has upper case letters, as reference.ParseNormalizedNamed does.
+func Qualified(image string) bool {
+	first, _, found := strings.Cut(image, "/")
+	if !found {
+		return false
+	}
+	return strings.ContainsAny(first, ".:") || first == "localhost" || strings.ToLower(first) != first
+}
+
+// Official reports whether the reference is a Docker Hub official image, e.g. docker.io/library/nginx.
+func (r *Reference) Official() bool {
+	return r.Registry == "docker.io" && strings.HasPrefix(r.Repository, "library/") && strings.Count(r.Repository, "/") == 1
+}
+
+// Name renders the repository with tag and digest, without registry.
+func (r *Reference) Name(opts RenderOptions) string {
+	name := r.Repository
+	if opts.OfficialPrefix != nil && r.Official() {
+		name = path.Join(*opts.OfficialPrefix, strings.TrimPrefix(r.Repository, "library/"))
+	}
+	if r.Tag != "" && !(r.ImplicitTag && opts.OmitImplicitTag) {
+		name += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		name += "@" + r.Digest
+	}
+	return name
+}
+
+// WithRegistry returns a copy of the reference on the registry, single segment
+// repositories on Docker Hub are normalized with the library prefix.
+func (r *Reference) WithRegistry(registry string) *Reference {
+	result := *r
+	result.Registry = registry
+	if registry == "docker.io" && !strings.Contains(result.Repository, "/") {
+		result.Repository = "library/" + result.Repository
+	}
+	return &result
+}
+
+// String returns the fully qualified image of the reference.
+func (r *Reference) String() string {
+	return r.Registry + "/" + r.Name(RenderOptions{})
+}
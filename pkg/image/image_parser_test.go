@@ -82,3 +82,98 @@ func TestParseImage(t *testing.T) {
 		}
 	}
 }
+
+func TestParseReference(t *testing.T) {
+	const digest = "sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa"
+
+	testdata := []struct {
+		image    string
+		expected Reference
+	}{
+		{
+			image:    "nginx",
+			expected: Reference{Registry: "docker.io", Repository: "library/nginx", Tag: "latest", ImplicitTag: true},
+		}, {
+			image:    "nginx:1.25",
+			expected: Reference{Registry: "docker.io", Repository: "library/nginx", Tag: "1.25"},
+		}, {
+			image:    "nginx@" + digest,
+			expected: Reference{Registry: "docker.io", Repository: "library/nginx", Digest: digest},
+		}, {
+			image:    "nginx:1.25@" + digest,
+			expected: Reference{Registry: "docker.io", Repository: "library/nginx", Tag: "1.25", Digest: digest},
+		}, {
+			image:    "username/image",
+			expected: Reference{Registry: "docker.io", Repository: "username/image", Tag: "latest", ImplicitTag: true},
+		}, {
+			image:    "registry.k8s.io/pause:3.9",
+			expected: Reference{Registry: "registry.k8s.io", Repository: "pause", Tag: "3.9"},
+		}, {
+			image:    "localhost:5000/username/image",
+			expected: Reference{Registry: "localhost:5000", Repository: "username/image", Tag: "latest", ImplicitTag: true},
+		},
+	}
+
+	for _, td := range testdata {
+		ref, err := ParseReference(td.image)
+		if err != nil {
+			t.Errorf("parse image %s failed: %v", td.image, err)
+			continue
+		}
+		if *ref != td.expected {
+			t.Errorf("parse image %s failed, expected: %+v, got: %+v", td.image, td.expected, *ref)
+		}
+	}
+}
+
+func TestReferenceName(t *testing.T) {
+	var (
+		keep   *string
+		short  = new(string)
+		custom = func() *string { s := "official"; return &s }()
+	)
+
+	testdata := []struct {
+		image           string
+		officialPrefix  *string
+		omitImplicitTag bool
+		name            string
+	}{
+		// official image with implicit tag
+		{image: "nginx", officialPrefix: keep, omitImplicitTag: false, name: "library/nginx:latest"},
+		{image: "nginx", officialPrefix: keep, omitImplicitTag: true, name: "library/nginx"},
+		{image: "nginx", officialPrefix: short, omitImplicitTag: false, name: "nginx:latest"},
+		{image: "nginx", officialPrefix: short, omitImplicitTag: true, name: "nginx"},
+		{image: "nginx", officialPrefix: custom, omitImplicitTag: false, name: "official/nginx:latest"},
+		{image: "nginx", officialPrefix: custom, omitImplicitTag: true, name: "official/nginx"},
+		// official image with explicit tag
+		{image: "docker.io/library/nginx:latest", officialPrefix: keep, omitImplicitTag: true, name: "library/nginx:latest"},
+		{image: "nginx:1.25", officialPrefix: keep, omitImplicitTag: false, name: "library/nginx:1.25"},
+		{image: "nginx:1.25", officialPrefix: keep, omitImplicitTag: true, name: "library/nginx:1.25"},
+		{image: "nginx:1.25", officialPrefix: short, omitImplicitTag: false, name: "nginx:1.25"},
+		{image: "nginx:1.25", officialPrefix: short, omitImplicitTag: true, name: "nginx:1.25"},
+		{image: "nginx:1.25", officialPrefix: custom, omitImplicitTag: false, name: "official/nginx:1.25"},
+		{image: "nginx:1.25", officialPrefix: custom, omitImplicitTag: true, name: "official/nginx:1.25"},
+		// official image with digest
+		{image: "nginx@sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa", officialPrefix: short, omitImplicitTag: true, name: "nginx@sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa"},
+		// non-official images are never affected by the official prefix
+		{image: "username/image", officialPrefix: keep, omitImplicitTag: false, name: "username/image:latest"},
+		{image: "username/image", officialPrefix: short, omitImplicitTag: true, name: "username/image"},
+		{image: "username/image:tag", officialPrefix: custom, omitImplicitTag: true, name: "username/image:tag"},
+		{image: "docker.io/library/team/image", officialPrefix: short, omitImplicitTag: false, name: "library/team/image:latest"},
+		{image: "quay.io/library/image:tag", officialPrefix: short, omitImplicitTag: false, name: "library/image:tag"},
+		{image: "quay.io/username/image", officialPrefix: custom, omitImplicitTag: true, name: "username/image"},
+	}
+
+	for _, td := range testdata {
+		ref, err := ParseReference(td.image)
+		if err != nil {
+			t.Errorf("parse image %s failed: %v", td.image, err)
+			continue
+		}
+		name := ref.Name(RenderOptions{OfficialPrefix: td.officialPrefix, OmitImplicitTag: td.omitImplicitTag})
+		if name != td.name {
+			t.Errorf("render image %s failed, expected: %s, got: %s", td.image, td.name, name)
+		}
+	}
+}
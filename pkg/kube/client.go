@@ -33,3 +33,8 @@ func Client() kubernetes.Interface {
 	}
 	return client
 }
+
+// SetClient sets the kubernetes client instance, e.g. a fake client in tests.
+func SetClient(c kubernetes.Interface) {
+	client = c
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// manifestMediaTypes is the accepted manifest media types, indexes first so that
+// the digest of a multi-arch image is the digest of its index.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+var (
+	// ErrNotFound is returned when the manifest does not exist in the registry.
+	ErrNotFound = errors.New("manifest not found")
+	// ErrUnauthorized is returned when the anonymous access to the repository is denied.
+	ErrUnauthorized = errors.New("unauthorized")
+)
+
+// Client is an anonymous client of the OCI distribution API.
+type Client struct {
+	httpClient *http.Client
+}
+
+// NewClient returns a registry client using the given http client,
+// http.DefaultClient is used if httpClient is nil.
+func NewClient(httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{httpClient: httpClient}
+}
+
+// Digest returns the manifest digest of the repository's reference(tag or digest)
+// by the `HEAD /v2/<name>/manifests/<reference>` request.
+func (c *Client) Digest(ctx context.Context, registry, repository, reference string) (string, error) {
+	u := fmt.Sprintf("https://%s/v2/%s/manifests/%s", APIHost(registry), repository, reference)
+	resp, err := c.do(ctx, http.MethodHead, u, repository, http.Header{
+		"Accept": {strings.Join(manifestMediaTypes, ", ")},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", fmt.Errorf("head manifest %s/%s:%s: %w", registry, repository, reference, ErrNotFound)
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", fmt.Errorf("head manifest %s/%s:%s: %w", registry, repository, reference, ErrUnauthorized)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("head manifest %s/%s:%s: unexpected status %s", registry, repository, reference, resp.Status)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("head manifest %s/%s:%s: no digest in response", registry, repository, reference)
+	}
+	return digest, nil
+}
+
+// do sends the request, and retries with an anonymous bearer token if the
+// registry challenges for one.
+func (c *Client) do(ctx context.Context, method, u, repository string, header http.Header) (*http.Response, error) {
+	resp, err := c.send(ctx, method, u, header)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	resp.Body.Close()
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return nil, fmt.Errorf("%s %s: %w", method, u, ErrUnauthorized)
+	}
+	token, err := c.token(ctx, parseChallenge(challenge[len("bearer "):]), repository)
+	if err != nil {
+		return nil, err
+	}
+
+	header = header.Clone()
+	header.Set("Authorization", "Bearer "+token)
+	return c.send(ctx, method, u, header)
+}
+
+// send sends the request
+func (c *Client) send(ctx context.Context, method, u string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	return c.httpClient.Do(req)
+}
+
+// token requests an anonymous pull token from the realm of the challenge.
+func (c *Client) token(ctx context.Context, params map[string]string, repository string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid token realm %q", params["realm"])
+	}
+
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	if scope := params["scope"]; scope != "" {
+		query.Set("scope", scope)
+	} else {
+		query.Set("scope", fmt.Sprintf("repository:%s:pull", repository))
+	}
+	realm.RawQuery = query.Encode()
+
+	resp, err := c.send(ctx, http.MethodGet, realm.String(), http.Header{})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", fmt.Errorf("request token from %s: %w", realm.Host, ErrUnauthorized)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("request token from %s: unexpected status %s", realm.Host, resp.Status)
+	}
+
+	var result struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("decode token from %s: %v", realm.Host, err)
+	}
+	if result.Token != "" {
+		return result.Token, nil
+	}
+	if result.AccessToken != "" {
+		return result.AccessToken, nil
+	}
+	return "", fmt.Errorf("no token from %s", realm.Host)
+}
+
+// parseChallenge parses the parameters of a WWW-Authenticate challenge,
+// e.g. realm="https://auth.docker.io/token",service="registry.docker.io".
+func parseChallenge(s string) map[string]string {
+	params := make(map[string]string)
+	for s = strings.TrimSpace(s); s != ""; {
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		params[key] = value
+		s = strings.TrimLeft(strings.TrimSpace(rest), ",")
+		s = strings.TrimSpace(s)
+	}
+	return params
+}
+
+// APIHost returns the host serving the distribution API of the registry.
+func APIHost(registry string) string {
+	if registry == "docker.io" {
+		return "registry-1.docker.io"
+	}
+	return registry
+}
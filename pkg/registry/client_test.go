@@ -0,0 +1,89 @@
+/*
+Copyright 2024 The Ketches Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDigest(t *testing.T) {
+	const digest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			got := r.URL.Query().Get("scope")
+			if strings.HasPrefix(got, "repository:private/") {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if !strings.HasPrefix(got, "repository:library/") {
+				t.Errorf("unexpected token scope: %s", got)
+			}
+			fmt.Fprint(w, `{"token":"anonymous"}`)
+		case r.Header.Get("Authorization") != "Bearer anonymous":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.Method == http.MethodHead && r.URL.Path == "/v2/library/nginx/manifests/latest":
+			w.Header().Set("Docker-Content-Digest", digest)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.Client())
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	got, err := client.Digest(context.Background(), host, "library/nginx", "latest")
+	if err != nil {
+		t.Fatalf("resolve digest failed: %v", err)
+	}
+	if got != digest {
+		t.Errorf("resolve digest failed, expected: %s, got: %s", digest, got)
+	}
+
+	if _, err := client.Digest(context.Background(), host, "library/redis", "latest"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("resolve digest of missing image should fail with ErrNotFound, got: %v", err)
+	}
+
+	if _, err := client.Digest(context.Background(), host, "private/app", "latest"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("resolve digest of private image should fail with ErrUnauthorized, got: %v", err)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	params := parseChallenge(`realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull"`)
+
+	expected := map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/nginx:pull",
+	}
+	for k, v := range expected {
+		if params[k] != v {
+			t.Errorf("parse challenge failed, expected %s: %s, got: %s", k, v, params[k])
+		}
+	}
+}